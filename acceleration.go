@@ -0,0 +1,109 @@
+package metric
+
+import "time"
+
+// NewAcceleration returns a metric that reports both the rate of change of the
+// incoming absolute values per second, like NewDerivative, and the rate of
+// change of that rate per second, e.g. whether the traffic is ramping up:
+// {"type":"accel","rate":...,"accel":...}. The acceleration is known once
+// three values have arrived. The timeline total reports the most recent rate
+// and the acceleration between the oldest and the newest rate in the window.
+func NewAcceleration(frames ...string) Metric {
+	return newMetric(func() metric { return &acceleration{} }, frames...)
+}
+
+type acceleration struct {
+	derivative
+	accel float64
+	// prev is the last known rate, kept across resets to compute the next
+	// acceleration
+	prev  float64
+	rated bool
+	// first and firstRate are the time and the value of the first rate
+	// computed within the sample
+	first     time.Time
+	firstRate float64
+}
+
+func (a *acceleration) carry(prev metric) {
+	p := prev.(*acceleration)
+	p.Lock()
+	last, at, rate, rated := p.last, p.at, p.prev, p.rated
+	p.Unlock()
+	a.Lock()
+	defer a.Unlock()
+	a.last, a.at, a.prev, a.rated = last, at, rate, rated
+}
+
+// Reset clears the rate and the acceleration, but keeps the last absolute
+// value and the last rate so that both are known as soon as the next value
+// arrives.
+func (a *acceleration) Reset() {
+	a.Lock()
+	defer a.Unlock()
+	a.reset()
+	a.rate, a.accel, a.count = 0, 0, 0
+	a.first = time.Time{}
+}
+
+func (a *acceleration) Add(n float64) {
+	a.Lock()
+	defer a.Unlock()
+	t := now()
+	if !a.at.IsZero() {
+		if dt := t.Sub(a.at).Seconds(); dt > 0 {
+			rate := (n - a.last) / dt
+			if a.rated {
+				a.accel = (rate - a.prev) / dt
+			}
+			a.rate, a.prev, a.rated = rate, rate, true
+			if a.first.IsZero() {
+				a.first, a.firstRate = t, rate
+			}
+		}
+	}
+	a.last, a.at = n, t
+	a.count++
+	a.touch()
+}
+
+func (a *acceleration) MarshalJSON() ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	return marshal(struct {
+		Type  string    `json:"type"`
+		Rate  float64   `json:"rate"`
+		Accel float64   `json:"accel"`
+		Meta  *MetaJSON `json:"_meta,omitempty"`
+	}{"accel", a.rate, a.accel, a.meta.meta()})
+}
+
+// Aggregate reports the most recent known rate within the samples and the
+// acceleration between the oldest and the newest rate.
+func (a *acceleration) Aggregate(roll int, samples []metric) {
+	a.Lock()
+	defer a.Unlock()
+	a.touch()
+	a.rate, a.accel = 0, 0
+	var newest, oldest *acceleration
+	var at, first time.Time
+	var firstRate float64
+	for _, s := range samples {
+		s := s.(*acceleration)
+		s.Lock()
+		if !s.first.IsZero() {
+			if newest == nil {
+				newest = s
+				a.rate, a.accel, at = s.rate, s.accel, s.at
+			}
+			oldest = s
+			first, firstRate = s.first, s.firstRate
+		}
+		s.Unlock()
+	}
+	if oldest != nil {
+		if dt := at.Sub(first).Seconds(); dt > 0 {
+			a.accel = (a.rate - firstRate) / dt
+		}
+	}
+}
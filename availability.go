@@ -0,0 +1,42 @@
+package metric
+
+// NewAvailability returns a metric for "is up" signals, e.g. health checks:
+// Add(1) records that the service is up and Add(0) that it is down, other
+// non-zero values count as up. It reports the fraction of the observations
+// that were up and the last observed state, 1 or 0:
+// {"type":"avail","uptime":...,"state":...}. Observations are weighted
+// equally, so the uptime matches the fraction of time only if the state is
+// recorded periodically, e.g. each time the health check runs.
+func NewAvailability(frames ...string) Metric {
+	return newMetric(func() metric { return &availability{} }, frames...)
+}
+
+type availability struct {
+	gauge
+}
+
+func (a *availability) Add(n float64) {
+	if n != 0 {
+		n = 1
+	}
+	a.gauge.Add(n)
+}
+
+func (a *availability) MarshalJSON() ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	return marshal(struct {
+		Type   string    `json:"type"`
+		Uptime float64   `json:"uptime"`
+		State  float64   `json:"state"`
+		Meta   *MetaJSON `json:"_meta,omitempty"`
+	}{"avail", a.mean(), a.value, a.meta.meta()})
+}
+
+func (a *availability) Aggregate(roll int, samples []metric) {
+	gauges := make([]metric, len(samples))
+	for i, s := range samples {
+		gauges[i] = &s.(*availability).gauge
+	}
+	a.gauge.Aggregate(roll, gauges)
+}
@@ -0,0 +1,65 @@
+package metric
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvQuantiles are the quantiles reported for histograms, like in JSON.
+var csvQuantiles = []float64{0.5, 0.9, 0.99}
+
+// WriteCSV writes the metric as CSV, e.g. to load it into a spreadsheet. The
+// first column is the sample start time in RFC 3339 format with fractional
+// seconds, followed by the value printed by String, or by the "p50", "p90" and
+// "p99" columns for histograms.
+// Timelines are written one row per sample, oldest first, stitched together
+// like in Series, metrics without frames are written as a single row with the
+// current time.
+func WriteCSV(w io.Writer, m Metric) error {
+	sample, timeline := m, true
+	switch ts := m.(type) {
+	case *timeseries:
+		sample = ts.total
+	case multimetric:
+		sample = ts[0].total
+	default:
+		timeline = false
+	}
+	_, hist := sample.(Histogram)
+	header := []string{"time", "value"}
+	values := func(s Metric) []float64 { return []float64{pointValue(s)} }
+	if hist {
+		header = []string{"time", "p50", "p90", "p99"}
+		values = func(s Metric) []float64 {
+			h := s.(Histogram)
+			v := make([]float64, len(csvQuantiles))
+			for i, q := range csvQuantiles {
+				v[i] = h.Quantile(q)
+			}
+			return v
+		}
+	}
+	rows := []row{{now(), nil}}
+	if timeline {
+		rows = stitch(m, values)
+	} else {
+		rows[0].values = values(m)
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		record := []string{r.start.Format(time.RFC3339Nano)}
+		for _, v := range r.values {
+			record = append(record, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
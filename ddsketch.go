@@ -0,0 +1,273 @@
+package metric
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// NewRelativeHistogram returns a histogram metric with a guaranteed relative
+// accuracy of the quantiles, e.g. 0.01 means that the reported quantiles are
+// within 1% of the real values. Values are counted in logarithmic buckets, as
+// in DDSketch, so that memory grows with the logarithm of the value range
+// rather than with the number of observations. Unlike NewHistogram, samples
+// are merged exactly, so timeline totals are precise as well. It is marshaled
+// like other histograms.
+func NewRelativeHistogram(accuracy float64, frames ...string) Metric {
+	if !(accuracy > 0 && accuracy < 1) {
+		accuracy = 0.01
+	}
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return newMetric(func() metric {
+		return &ddsketch{accuracy: accuracy, gamma: gamma, lnGamma: math.Log(gamma),
+			pos: map[int]float64{}, neg: map[int]float64{}}
+	}, frames...)
+}
+
+type ddsketch struct {
+	sync.Mutex
+	meta
+	accuracy float64
+	gamma    float64
+	lnGamma  float64
+	pos      map[int]float64 // counts of positive values by bucket index
+	neg      map[int]float64 // counts of negative values by the index of -x
+	zero     float64
+	count    float64
+	min      float64
+	max      float64
+}
+
+// minIndexable is the smallest magnitude that has its own bucket, smaller
+// values are counted as zeros.
+const minIndexable = 1e-9
+
+func (d *ddsketch) index(x float64) int {
+	return int(math.Ceil(math.Log(x) / d.lnGamma))
+}
+
+// value returns the estimate of all values in the bucket, which is within the
+// relative accuracy of any of them.
+func (d *ddsketch) value(i int) float64 {
+	return 2 * math.Pow(d.gamma, float64(i)) / (d.gamma + 1)
+}
+
+func (d *ddsketch) String() string {
+	b, _ := d.MarshalJSON()
+	return string(b)
+}
+
+func (d *ddsketch) Reset() {
+	d.Lock()
+	defer d.Unlock()
+	d.reset()
+	d.clear()
+}
+
+func (d *ddsketch) clear() {
+	for i := range d.pos {
+		delete(d.pos, i)
+	}
+	for i := range d.neg {
+		delete(d.neg, i)
+	}
+	d.zero, d.count, d.min, d.max = 0, 0, 0, 0
+}
+
+func (d *ddsketch) Add(n float64) {
+	d.AddWeighted(n, 1)
+}
+
+// AddWeighted adds a value that has been observed weight times. Zero,
+// negative and NaN weights are ignored.
+func (d *ddsketch) AddWeighted(n, weight float64) {
+	if !(weight > 0) {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.add(n, weight)
+}
+
+// AddPairs adds a batch of weighted observations.
+func (d *ddsketch) AddPairs(pairs []Bin) {
+	d.Lock()
+	defer d.Unlock()
+	for _, p := range pairs {
+		if p.Count > 0 {
+			d.add(p.Value, p.Count)
+		}
+	}
+}
+
+func (d *ddsketch) add(n, weight float64) {
+	d.touch()
+	switch {
+	case n > minIndexable:
+		d.pos[d.index(n)] += weight
+	case n < -minIndexable:
+		d.neg[d.index(-n)] += weight
+	default:
+		d.zero += weight
+	}
+	if n < d.min || d.count == 0 {
+		d.min = n
+	}
+	if n > d.max || d.count == 0 {
+		d.max = n
+	}
+	d.count += weight
+}
+
+// Quantile returns the value below which the given fraction of observations
+// fall, within the relative accuracy.
+func (d *ddsketch) Quantile(q float64) float64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.quantile(q)
+}
+
+func (d *ddsketch) quantile(q float64) float64 {
+	if q = clampQuantile(q); math.IsNaN(q) {
+		return q
+	}
+	if d.count == 0 {
+		return 0
+	}
+	rank := q * (d.count - 1)
+	sum := 0.0
+	// Negative values come first, from the largest magnitude to the smallest
+	neg := sortedKeys(d.neg)
+	for i := len(neg) - 1; i >= 0; i-- {
+		if sum += d.neg[neg[i]]; sum > rank {
+			return d.clamp(-d.value(neg[i]))
+		}
+	}
+	if sum += d.zero; sum > rank {
+		return 0
+	}
+	pos := sortedKeys(d.pos)
+	for _, i := range pos {
+		if sum += d.pos[i]; sum > rank {
+			return d.clamp(d.value(i))
+		}
+	}
+	return d.max
+}
+
+// Mode returns the estimate of the bucket with the most observations.
+func (d *ddsketch) Mode() float64 {
+	return mode(d.snapshot())
+}
+
+// Rank returns the fraction of observations less than or equal to the value,
+// within the relative accuracy of the value.
+func (d *ddsketch) Rank(value float64) float64 {
+	d.Lock()
+	defer d.Unlock()
+	if d.count == 0 || value < d.min {
+		return 0
+	} else if value >= d.max {
+		return 1
+	}
+	count := 0.0
+	for i, c := range d.neg {
+		if -d.value(i) <= value {
+			count += c
+		}
+	}
+	if value >= 0 {
+		count += d.zero
+	}
+	for i, c := range d.pos {
+		if d.value(i) <= value {
+			count += c
+		}
+	}
+	return count / d.count
+}
+
+// snapshot returns the buckets as bins valued by their estimates.
+func (d *ddsketch) snapshot() []Bin {
+	d.Lock()
+	defer d.Unlock()
+	bins := []Bin{}
+	for i, c := range d.neg {
+		bins = append(bins, Bin{Value: -d.value(i), Count: c})
+	}
+	if d.zero > 0 {
+		bins = append(bins, Bin{Count: d.zero})
+	}
+	for i, c := range d.pos {
+		bins = append(bins, Bin{Value: d.value(i), Count: c})
+	}
+	return bins
+}
+
+// clamp keeps the estimate within the observed range.
+func (d *ddsketch) clamp(x float64) float64 {
+	return math.Max(d.min, math.Min(d.max, x))
+}
+
+func sortedKeys(m map[int]float64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func (d *ddsketch) MarshalJSON() ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	p50, p90, p99 := d.quantile(0.5), d.quantile(0.9), d.quantile(0.99)
+	return marshal(HistogramJSON{Type: "h", P50: p50, P90: p90, P99: p99, Min: d.min, Max: d.max, Mean: d.mean(),
+		P50Err: d.accuracy * math.Abs(p50), P90Err: d.accuracy * math.Abs(p90), P99Err: d.accuracy * math.Abs(p99),
+		Meta: d.meta.meta()})
+}
+
+// mean estimates the mean from the bucket values, within the relative
+// accuracy.
+func (d *ddsketch) mean() float64 {
+	if d.count == 0 {
+		return 0
+	}
+	sum := 0.0
+	for i, c := range d.pos {
+		sum += d.value(i) * c
+	}
+	for i, c := range d.neg {
+		sum -= d.value(i) * c
+	}
+	return sum / d.count
+}
+
+// Aggregate merges the samples, which is exact for logarithmic buckets.
+func (d *ddsketch) Aggregate(roll int, samples []metric) {
+	d.Lock()
+	defer d.Unlock()
+	d.touch()
+	d.clear()
+	for _, s := range samples {
+		s := s.(*ddsketch)
+		s.Lock()
+		if s.count > 0 {
+			for i, c := range s.pos {
+				d.pos[i] += c
+			}
+			for i, c := range s.neg {
+				d.neg[i] += c
+			}
+			if s.min < d.min || d.count == 0 {
+				d.min = s.min
+			}
+			if s.max > d.max || d.count == 0 {
+				d.max = s.max
+			}
+			d.zero += s.zero
+			d.count += s.count
+		}
+		s.Unlock()
+	}
+}
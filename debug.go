@@ -0,0 +1,129 @@
+package metric
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// DebugJSON returns the full internal state of the metric as JSON, e.g.
+// histogram bins with their counts, gauge sums or the timeline ring position.
+// It is meant for troubleshooting odd values and its format is not stable.
+// Unlike other reads it does not roll timelines, so the state is exactly as
+// it was left by the last update.
+func DebugJSON(m Metric) ([]byte, error) {
+	return json.Marshal(debugState(m))
+}
+
+// debugger is implemented by metrics that can dump their internal state.
+type debugger interface {
+	debug() interface{}
+}
+
+func debugState(m Metric) interface{} {
+	var state interface{}
+	walk(m, func(m Metric) bool {
+		state = m
+		if d, ok := m.(debugger); ok {
+			state = d.debug()
+			return true
+		}
+		return false
+	})
+	return state
+}
+
+func (ts *timeseries) debug() interface{} {
+	ts.Lock()
+	defer ts.Unlock()
+	samples := make([]interface{}, len(ts.samples))
+	for i, s := range ts.samples {
+		samples[i] = debugState(s)
+	}
+	return struct {
+		Interval time.Duration `json:"interval"`
+		Now      time.Time     `json:"now"`
+		Start    time.Time     `json:"start"`
+		Bucket   time.Time     `json:"bucket"`
+		Partial  int           `json:"partial"`
+		Total    interface{}   `json:"total"`
+		Samples  []interface{} `json:"samples"`
+	}{ts.interval, ts.now, ts.start, ts.bucket(ts.now), ts.partial(), debugState(ts.total), samples}
+}
+
+func (mm multimetric) debug() interface{} {
+	frames := make([]interface{}, len(mm))
+	for i, ts := range mm {
+		frames[i] = ts.debug()
+	}
+	return frames
+}
+
+func (c *counter) debug() interface{} {
+	return struct {
+		Count    float64 `json:"count"`
+		Overflow bool    `json:"overflow"`
+		Version  uint64  `json:"version"`
+	}{c.value(), atomic.LoadUint32(&c.overflow) != 0, c.version()}
+}
+
+func (g *gauge) debug() interface{} {
+	g.Lock()
+	defer g.Unlock()
+	return struct {
+		Value   float64 `json:"value"`
+		Sum     float64 `json:"sum"`
+		Count   int     `json:"count"`
+		Min     float64 `json:"min"`
+		Max     float64 `json:"max"`
+		Up      int     `json:"up"`
+		Down    int     `json:"down"`
+		Seeded  bool    `json:"seeded"`
+		Version uint64  `json:"version"`
+	}{g.value, g.sum, g.count, g.min, g.max, g.up, g.down, g.seeded, g.version()}
+}
+
+func (g *meanGauge) debug() interface{} {
+	g.Lock()
+	defer g.Unlock()
+	return struct {
+		Sum     float64 `json:"sum"`
+		Count   int     `json:"count"`
+		Version uint64  `json:"version"`
+	}{g.sum, g.count, g.version()}
+}
+
+func (h *histogram) debug() interface{} {
+	h.Lock()
+	defer h.Unlock()
+	return struct {
+		Bins    []Bin   `json:"bins"`
+		Total   float64 `json:"total"`
+		Version uint64  `json:"version"`
+	}{append([]Bin{}, h.bins...), h.total, h.version()}
+}
+
+func (d *derivative) debug() interface{} {
+	d.Lock()
+	defer d.Unlock()
+	return struct {
+		Last    float64   `json:"last"`
+		At      time.Time `json:"at"`
+		Rate    float64   `json:"rate"`
+		Count   int       `json:"count"`
+		Version uint64    `json:"version"`
+	}{d.last, d.at, d.rate, d.count, d.version()}
+}
+
+func (ps *psquare) debug() interface{} {
+	ps.Lock()
+	defer ps.Unlock()
+	return struct {
+		P       float64    `json:"p"`
+		Count   int        `json:"count"`
+		Heights [5]float64 `json:"heights"`
+		Pos     [5]float64 `json:"positions"`
+		Desired [5]float64 `json:"desired"`
+		Version uint64     `json:"version"`
+	}{ps.p, ps.count, ps.q, ps.n, ps.np, ps.version()}
+}
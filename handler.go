@@ -1,19 +1,26 @@
 package metric
 
 import (
+	"bufio"
 	"encoding/json"
 	"expvar"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"html/template"
 )
 
 var (
 	page = template.Must(template.New("").
-		Funcs(template.FuncMap{"path": path, "duration": duration}).
+		Funcs(template.FuncMap{"path": path, "duration": duration, "num": num, "has": has}).
 		Parse(`<!DOCTYPE html>
 <html lang="us">
 <meta charset="utf-8">
@@ -89,13 +96,34 @@ path:last-child { stroke: black; }
 {{ define "table" }}
 <table class="table col-1">
 	{{ if eq .type "c" }}
-		<thead><tr><th>count</th></tr></thead><tbody><tr><td>{{ printf "%.2g" .count }}</td></tr></tbody>
+		<thead><tr><th>count</th></tr></thead><tbody><tr><td>{{ num .count }}</td></tr></tbody>
+	{{ else if and (eq .type "g") (not (has . "max")) }}
+		<thead><tr><th>mean</th></tr></thead><tbody><tr><td>{{ num .mean }}</td></tr></tbody>
 	{{ else if eq .type "g" }}
 		<thead><tr><th>mean</th><th>min</th><th>max</th></tr></thead>
-		<tbody><tr><td>{{printf "%.2g" .mean}}</td><td>{{printf "%.2g" .min}}</td><td>{{printf "%.2g" .max}}</td></th></tbody>
+		<tbody><tr><td>{{ num .mean }}</td><td>{{ num .min }}</td><td>{{ num .max }}</td></th></tbody>
 	{{ else if eq .type "h" }}
 		<thead><tr><th>P.50</th><th>P.90</th><th>P.99</th></tr></thead>
-		<tbody><tr><td>{{printf "%.2g" .p50}}</td><td>{{printf "%.2g" .p90}}</td><td>{{printf "%.2g" .p99}}</td></tr></tbody>
+		<tbody><tr><td>{{ num .p50 }}</td><td>{{ num .p90 }}</td><td>{{ num .p99 }}</td></tr></tbody>
+	{{ else if eq .type "deriv" }}
+		<thead><tr><th>rate</th></tr></thead><tbody><tr><td>{{ num .rate }}</td></tr></tbody>
+	{{ else if eq .type "accel" }}
+		<thead><tr><th>rate</th><th>accel</th></tr></thead>
+		<tbody><tr><td>{{ num .rate }}</td><td>{{ num .accel }}</td></tr></tbody>
+	{{ else if eq .type "avail" }}
+		<thead><tr><th>uptime</th><th>state</th></tr></thead>
+		<tbody><tr><td>{{ num .uptime }}</td><td>{{ num .state }}</td></tr></tbody>
+	{{ else if eq .type "rc" }}
+		<thead><tr><th>count</th><th>rate</th></tr></thead>
+		<tbody><tr><td>{{ num .count }}</td><td>{{ num .rate }}</td></tr></tbody>
+	{{ else if eq .type "p2" }}
+		<thead><tr><th>P{{ .p }}</th></tr></thead><tbody><tr><td>{{ num .value }}</td></tr></tbody>
+	{{ else if eq .type "hm" }}
+		<thead><tr>{{ range .bounds }}<th>&le;{{ num . }}</th>{{ end }}<th>&gt;</th></tr></thead>
+		<tbody><tr>{{ range .counts }}<td>{{ num . }}</td>{{ end }}</tr></tbody>
+	{{ else if eq .type "topk" }}
+		<thead><tr><th>key</th><th>count</th></tr></thead>
+		<tbody>{{ range .items }}<tr><td>{{ .key }}</td><td>{{ num .count }}</td></tr>{{ end }}</tbody>
 	{{ end }}
 </table>
 {{ end }}
@@ -107,10 +135,22 @@ path:last-child { stroke: black; }
 			<svg class="col-1" version="1.1" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 20">
 			{{ if eq (index (index .samples 0) "type") "c" }}
 				{{ range (path .samples "count") }}<path d={{ . }} />{{end}}
+			{{ else if and (eq (index (index .samples 0) "type") "g") (not (has (index .samples 0) "max")) }}
+				{{ range (path .samples "mean" ) }}<path d={{ . }} />{{end}}
 			{{ else if eq (index (index .samples 0) "type") "g" }}
 				{{ range (path .samples "min" "max" "mean" ) }}<path d={{ . }} />{{end}}
 			{{ else if eq (index (index .samples 0) "type") "h" }}
 				{{ range (path .samples "p50" "p90" "p99") }}<path d={{ . }} />{{end}}
+			{{ else if eq (index (index .samples 0) "type") "deriv" }}
+				{{ range (path .samples "rate") }}<path d={{ . }} />{{end}}
+			{{ else if eq (index (index .samples 0) "type") "accel" }}
+				{{ range (path .samples "rate") }}<path d={{ . }} />{{end}}
+			{{ else if eq (index (index .samples 0) "type") "avail" }}
+				{{ range (path .samples "uptime") }}<path d={{ . }} />{{end}}
+			{{ else if eq (index (index .samples 0) "type") "rc" }}
+				{{ range (path .samples "count") }}<path d={{ . }} />{{end}}
+			{{ else if eq (index (index .samples 0) "type") "p2" }}
+				{{ range (path .samples "value") }}<path d={{ . }} />{{end}}
 			{{ end }}
 			</svg>
 		</div>
@@ -125,7 +165,7 @@ func path(samples []interface{}, keys ...string) []string {
 	for i := 0; i < len(samples); i++ {
 		s := samples[i].(map[string]interface{})
 		for _, k := range keys {
-			x := s[k].(float64)
+			x, _ := s[k].(float64)
 			if i == 0 || x < min {
 				min = x
 			}
@@ -137,7 +177,7 @@ func path(samples []interface{}, keys ...string) []string {
 	for i := 0; i < len(samples); i++ {
 		s := samples[i].(map[string]interface{})
 		for j, k := range keys {
-			v := s[k].(float64)
+			v, _ := s[k].(float64)
 			x := float64(i+1) / float64(len(samples))
 			y := (v - min) / (max - min)
 			if max == min {
@@ -152,6 +192,18 @@ func path(samples []interface{}, keys ...string) []string {
 	return paths
 }
 
+// num formats a metric value for the web UI. Missing values, e.g. left out by
+// OmitEmpty, are shown as zeros.
+func num(v interface{}) string {
+	f, _ := v.(float64)
+	return fmt.Sprintf("%.2g", f)
+}
+
+func has(m map[string]interface{}, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
 func duration(samples []interface{}, n float64) string {
 	n = n * float64(len(samples))
 	if n < 60 {
@@ -164,12 +216,63 @@ func duration(samples []interface{}, n float64) string {
 	return fmt.Sprintf("%d days", int(n/24/60/60))
 }
 
-// Handler returns an http.Handler that renders web UI for all provided metrics.
+// changes returns an entity tag describing the current state of the given
+// metrics and the subset of metrics that have changed since the state
+// described by the tag from an If-None-Match header. All metrics are returned
+// if the tag is missing or stale, or if metrics have been added or removed
+// since. Metrics that don't keep track of their changes are always returned.
+func changes(metrics map[string]Metric, tag string) (string, map[string]Metric) {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	vers := map[string]uint64{}
+	var seq uint64
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		if v, ok := versionOf(metrics[name]); ok {
+			vers[name] = v
+			if v > seq {
+				seq = v
+			}
+		}
+	}
+	var (
+		sum   uint64
+		since uint64
+	)
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	if n, _ := fmt.Sscanf(tag, "%x-%d", &sum, &since); n != 2 || sum != h.Sum64() {
+		return fmt.Sprintf(`"%x-%d"`, h.Sum64(), seq), metrics
+	}
+	changed := map[string]Metric{}
+	for name, m := range metrics {
+		if v, ok := vers[name]; !ok || v > since {
+			changed[name] = m
+		}
+	}
+	return fmt.Sprintf(`"%x-%d"`, h.Sum64(), seq), changed
+}
+
+// Handler returns an http.Handler that renders web UI for all provided
+// metrics. It supports conditional requests: if none of the metrics have
+// changed since the response tagged with the If-None-Match ETag, 304 Not
+// Modified is returned.
 func Handler(snapshot func() map[string]Metric) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all := snapshot()
+		etag, changed := changes(all, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", etag)
+		if len(changed) == 0 && len(all) > 0 {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		type h map[string]interface{}
 		metrics := []h{}
-		for name, metric := range snapshot() {
+		for name, metric := range all {
 			m := h{}
 			b, _ := json.Marshal(metric)
 			json.Unmarshal(b, &m)
@@ -185,6 +288,180 @@ func Handler(snapshot func() map[string]Metric) http.Handler {
 	})
 }
 
+// JSONHandler returns an http.Handler that serves all provided metrics as a
+// single JSON object keyed by metric names.
+//
+// To save traffic on mostly idle metrics clients may send the ETag of the
+// previous response in the If-None-Match header. If nothing has changed since,
+// 304 Not Modified is returned. Otherwise only the changed metrics are
+// returned, which is indicated by the "X-Metrics-Delta: true" header. The
+// full set is returned if metrics have been added or removed in the meantime.
+//
+// With the "debug=1" query parameter the full internal state of each metric
+// is returned instead, see DebugJSON.
+func JSONHandler(snapshot func() map[string]Metric) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all := snapshot()
+		if r.URL.Query().Get("debug") == "1" {
+			state := map[string]interface{}{}
+			for name, m := range all {
+				state[name] = debugState(m)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state)
+			return
+		}
+		etag, changed := changes(all, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", etag)
+		if len(changed) == 0 && len(all) > 0 {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if len(changed) < len(all) {
+			w.Header().Set("X-Metrics-Delta", "true")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changed)
+	})
+}
+
+// truncated marks the end of a JSON response cut by LimitedJSONHandler.
+const truncated = `"_truncated":true}`
+
+// LimitedJSONHandler returns an http.Handler that serves metrics like
+// JSONHandler, but marshals and writes them one by one in the order of their
+// names, so that only a single metric is kept in memory at a time. Once the
+// response would exceed maxBytes the remaining metrics are left out and the
+// object ends with a "_truncated": true entry instead. Metrics that fail to
+// marshal are left out.
+func LimitedJSONHandler(snapshot func() map[string]Metric, maxBytes int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := snapshot()
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+		bw.WriteByte('{')
+		n, sep := 1, ""
+		for _, name := range names {
+			key, _ := json.Marshal(name)
+			b, err := json.Marshal(metrics[name])
+			if err != nil {
+				// Skip the metric, but keep writing the rest
+				continue
+			}
+			size := len(sep) + len(key) + 1 + len(b)
+			// Always leave room for the truncation marker
+			if n+size+len(","+truncated) > maxBytes {
+				bw.WriteString(sep + truncated)
+				return
+			}
+			bw.WriteString(sep)
+			bw.Write(key)
+			bw.WriteByte(':')
+			bw.Write(b)
+			n, sep = n+size, ","
+		}
+		bw.WriteByte('}')
+	})
+}
+
+// Mux returns an http.Handler that serves all provided metrics in every
+// supported format, so that all endpoints always expose the same set of
+// metrics. Web UI is served at /debug/metrics, unless the client accepts
+// application/json, in which case JSON is returned instead. Prometheus text
+// format is served at /metrics. Since both representations at /debug/metrics
+// share the ETags, responses vary by the Accept header.
+func Mux(snapshot func() map[string]Metric) http.Handler {
+	ui, js := Handler(snapshot), JSONHandler(snapshot)
+	mux := http.NewServeMux()
+	mux.Handle("/debug/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			js.ServeHTTP(w, r)
+		} else {
+			ui.ServeHTTP(w, r)
+		}
+	}))
+	mux.Handle("/metrics", PrometheusHandler(snapshot))
+	return mux
+}
+
+// ListenUnix serves all provided metrics (see Mux) over HTTP on a Unix domain
+// socket at the given path, e.g. for local agents, without opening a network
+// port. A stale socket file left by a previous process is replaced. Closing
+// the returned server stops serving and removes the socket file.
+func ListenUnix(path string, snapshot func() map[string]Metric) (io.Closer, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: Mux(snapshot)}
+	go srv.Serve(l)
+	return srv, nil
+}
+
+// Live returns a snapshot function that leaves out the metrics returned by the
+// given snapshot that have never received a value, e.g. to keep dashboards
+// free of empty timelines while the process warms up:
+//
+//	http.Handle("/debug/metrics", metric.Handler(metric.Live(metric.Exposed)))
+//
+// Metrics of unknown types are always included.
+func Live(snapshot func() map[string]Metric) func() map[string]Metric {
+	return func() map[string]Metric {
+		live := map[string]Metric{}
+		for name, m := range snapshot() {
+			if used(m) {
+				live[name] = m
+			}
+		}
+		return live
+	}
+}
+
+// used reports whether a value has ever been added to the metric. Metrics
+// without frames are considered used once they have changed.
+func used(m Metric) bool {
+	result := true
+	walk(m, func(m Metric) bool {
+		switch m := m.(type) {
+		case *timeseries:
+			result = atomic.LoadUint32(&m.used) != 0
+		case multimetric:
+			result = false
+			for _, ts := range m {
+				if used(ts) {
+					result = true
+				}
+			}
+		case versioned:
+			result = m.version() != 0
+		default:
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+// Register installs the web UI for all exposed metrics on
+// http.DefaultServeMux at the given path, or at /debug/metrics if the path is
+// empty, similarly to how expvar installs /debug/vars.
+func Register(path string) {
+	if path == "" {
+		path = "/debug/metrics"
+	}
+	http.Handle(path, Handler(Exposed))
+}
+
 // Exposed returns a map of exposed metrics (see expvar package).
 func Exposed() map[string]Metric {
 	m := map[string]Metric{}
@@ -195,3 +472,59 @@ func Exposed() map[string]Metric {
 	})
 	return m
 }
+
+// SnapshotAll returns frozen copies of the exposed metrics with the given
+// names, see Freeze, e.g. to compute a ratio of two counters. The metrics are
+// looked up first and then read back-to-back to keep the time between the
+// reads minimal. Names of missing metrics are left out.
+func SnapshotAll(names ...string) map[string]Metric {
+	metrics := make(map[string]Metric, len(names))
+	for _, name := range names {
+		if m, ok := expvar.Get(name).(Metric); ok {
+			metrics[name] = m
+		}
+	}
+	for name, m := range metrics {
+		metrics[name] = Freeze(m)
+	}
+	return metrics
+}
+
+// ResetAll resets all exposed metrics, e.g. to isolate test cases sharing the
+// global expvar state. Metrics published concurrently may be missed, but it's
+// safe to call while the metrics are in use.
+func ResetAll() {
+	for _, m := range Exposed() {
+		resetMetric(m)
+	}
+}
+
+var publishMu sync.Mutex
+
+// GetOrPublish returns the metric published under the given name, or builds a
+// new one, publishes it and returns it, so that the same metric can be safely
+// registered more than once, e.g. lazily from request handlers. It panics if
+// the name is taken by an expvar which is not a Metric.
+func GetOrPublish(name string, build func() Metric) Metric {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		m, ok := v.(Metric)
+		if !ok {
+			panic("metric: " + name + " is not a metric")
+		}
+		return m
+	}
+	m := build()
+	expvar.Publish(name, m)
+	return m
+}
+
+// MustPublish publishes the metric under the given name (see expvar.Publish)
+// and returns the metric itself, so that it can be used directly without
+// further expvar.Get lookups. Like expvar.Publish, it panics if the name is
+// already registered.
+func MustPublish(name string, m Metric) Metric {
+	expvar.Publish(name, m)
+	return m
+}
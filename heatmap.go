@@ -0,0 +1,82 @@
+package metric
+
+import (
+	"sort"
+	"sync"
+)
+
+// NewHeatmap returns a metric that counts incoming values in fixed buckets
+// defined by the ascending upper bounds, e.g. latency buckets in seconds. A
+// value falls into the first bucket whose bound is greater or equal to it,
+// values above the last bound are counted in an extra overflow bucket. Since
+// bucket boundaries are the same for all samples of a timeline, the samples
+// form a time/value grid suitable for heatmaps, e.g. in Grafana.
+func NewHeatmap(bounds []float64, frames ...string) Metric {
+	bounds = append([]float64{}, bounds...)
+	sort.Float64s(bounds)
+	return newMetric(func() metric {
+		return &heatmap{bounds: bounds, counts: make([]float64, len(bounds)+1)}
+	}, frames...)
+}
+
+type heatmap struct {
+	sync.Mutex
+	meta
+	bounds []float64
+	counts []float64
+	sum    float64
+}
+
+func (hm *heatmap) String() string {
+	b, _ := hm.MarshalJSON()
+	return string(b)
+}
+
+func (hm *heatmap) Reset() {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.reset()
+	for i := range hm.counts {
+		hm.counts[i] = 0
+	}
+	hm.sum = 0
+}
+
+func (hm *heatmap) Add(n float64) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.touch()
+	hm.counts[sort.SearchFloat64s(hm.bounds, n)]++
+	hm.sum += n
+}
+
+func (hm *heatmap) MarshalJSON() ([]byte, error) {
+	hm.Lock()
+	defer hm.Unlock()
+	return marshal(struct {
+		Type   string    `json:"type"`
+		Bounds []float64 `json:"bounds"`
+		Counts []float64 `json:"counts"`
+		Sum    float64   `json:"sum"`
+		Meta   *MetaJSON `json:"_meta,omitempty"`
+	}{"hm", hm.bounds, hm.counts, hm.sum, hm.meta.meta()})
+}
+
+func (hm *heatmap) Aggregate(roll int, samples []metric) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.touch()
+	for i := range hm.counts {
+		hm.counts[i] = 0
+	}
+	hm.sum = 0
+	for _, s := range samples {
+		s := s.(*heatmap)
+		s.Lock()
+		for i, c := range s.counts {
+			hm.counts[i] += c
+		}
+		hm.sum += s.sum
+		s.Unlock()
+	}
+}
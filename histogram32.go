@@ -0,0 +1,225 @@
+package metric
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// NewHistogram32 returns a histogram metric like NewHistogram that keeps its
+// bins in single precision, which halves the memory used by the bins at the
+// cost of precision: values and counts have about 7 significant digits, and
+// counts stop growing above 2^24 per bin. Quantiles are calculated in double
+// precision.
+func NewHistogram32(frames ...string) Metric {
+	return newMetric(func() metric { return &histogram32{} }, frames...)
+}
+
+type bin32 struct {
+	value float32
+	count float32
+}
+
+type histogram32 struct {
+	sync.Mutex
+	meta
+	bins []bin32
+}
+
+// total returns the sum of the bin counts. It's not kept separately, so that
+// quantiles never ask for more observations than the saturated float32
+// counts hold.
+func (h *histogram32) total() float64 {
+	total := 0.0
+	for _, b := range h.bins {
+		total = total + float64(b.count)
+	}
+	return total
+}
+
+func (h *histogram32) String() string {
+	b, _ := h.MarshalJSON()
+	return string(b)
+}
+
+func (h *histogram32) Reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.reset()
+	h.bins = h.bins[:0]
+}
+
+func (h *histogram32) Add(n float64) {
+	h.AddWeighted(n, 1)
+}
+
+// AddWeighted adds a value that has been observed weight times. Zero,
+// negative and NaN weights are ignored.
+func (h *histogram32) AddWeighted(n, weight float64) {
+	if !(weight > 0) {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	defer h.trim()
+	h.touch()
+	v := float32(n)
+	i := sort.Search(len(h.bins), func(i int) bool { return h.bins[i].value >= v })
+	if i < len(h.bins) && h.bins[i].value == v {
+		h.bins[i].count += float32(weight)
+		return
+	}
+	h.bins = append(h.bins, bin32{})
+	copy(h.bins[i+1:], h.bins[i:])
+	h.bins[i] = bin32{value: v, count: float32(weight)}
+}
+
+// AddPairs adds a batch of weighted observations. Pairs with non-positive
+// counts are ignored.
+func (h *histogram32) AddPairs(pairs []Bin) {
+	h.Lock()
+	defer h.Unlock()
+	h.touch()
+	for _, p := range pairs {
+		if p.Count > 0 {
+			h.bins = append(h.bins, bin32{value: float32(p.Value), count: float32(p.Count)})
+			if len(h.bins) >= 2*maxBins {
+				h.sort()
+				h.trim()
+			}
+		}
+	}
+	h.sort()
+	h.trim()
+}
+
+func (h *histogram32) sort() {
+	sort.SliceStable(h.bins, func(i, j int) bool { return h.bins[i].value < h.bins[j].value })
+}
+
+// trim merges the closest bins until there are no more than maxBins left.
+func (h *histogram32) trim() {
+	for len(h.bins) > maxBins {
+		d := float32(0)
+		i := 0
+		for j := 1; j < len(h.bins); j++ {
+			if dv := h.bins[j].value - h.bins[j-1].value; dv < d || j == 1 {
+				d = dv
+				i = j
+			}
+		}
+		a, b := h.bins[i-1], h.bins[i]
+		count := float64(a.count) + float64(b.count)
+		merged := bin32{
+			value: float32((float64(a.value)*float64(a.count) + float64(b.value)*float64(b.count)) / count),
+			count: float32(count),
+		}
+		h.bins = append(h.bins[:i-1], h.bins[i:]...)
+		h.bins[i-1] = merged
+	}
+}
+
+func (h *histogram32) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	hj := HistogramJSON{Type: "h", P50: h.quantile(0.5), P90: h.quantile(0.9), P99: h.quantile(0.99), Meta: h.meta.meta()}
+	if len(h.bins) > 0 {
+		hj.Min, hj.Max = float64(h.bins[0].value), float64(h.bins[len(h.bins)-1].value)
+	}
+	if total := h.total(); total > 0 {
+		for _, b := range h.bins {
+			hj.Mean += float64(b.value) * float64(b.count)
+		}
+		hj.Mean /= total
+	}
+	return marshal(hj)
+}
+
+// Quantile returns an approximate value below which the given fraction of
+// observations fall.
+func (h *histogram32) Quantile(q float64) float64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.quantile(q)
+}
+
+func (h *histogram32) quantile(q float64) float64 {
+	if q = clampQuantile(q); math.IsNaN(q) {
+		return q
+	}
+	if len(h.bins) == 0 {
+		return 0
+	}
+	count := q * h.total()
+	for _, b := range h.bins {
+		count -= float64(b.count)
+		if count <= 0 {
+			return float64(b.value)
+		}
+	}
+	// Rounding errors may leave a tiny remainder
+	return float64(h.bins[len(h.bins)-1].value)
+}
+
+// Rank returns the fraction of observations less than or equal to the value.
+func (h *histogram32) Rank(value float64) float64 {
+	h.Lock()
+	defer h.Unlock()
+	total := h.total()
+	if total == 0 {
+		return 0
+	}
+	count := 0.0
+	for _, b := range h.bins {
+		if float64(b.value) > value {
+			break
+		}
+		count = count + float64(b.count)
+	}
+	return count / total
+}
+
+func (h *histogram32) Mode() float64 {
+	return mode(h.snapshot())
+}
+
+func (h *histogram32) snapshot() []Bin {
+	h.Lock()
+	defer h.Unlock()
+	bins := make([]Bin, len(h.bins))
+	for i, b := range h.bins {
+		bins[i] = Bin{Value: float64(b.value), Count: float64(b.count)}
+	}
+	return bins
+}
+
+// merge replaces the bins with the bins of all samples.
+func (h *histogram32) merge(samples []metric) {
+	h.Lock()
+	defer h.Unlock()
+	h.touch()
+	h.bins = h.bins[:0]
+	for _, s := range samples {
+		s := s.(*histogram32)
+		s.Lock()
+		h.bins = append(h.bins, s.bins...)
+		s.Unlock()
+		if len(h.bins) >= 2*maxBins {
+			h.sort()
+			h.trim()
+		}
+	}
+	h.sort()
+	h.trim()
+}
+
+// Aggregate decays the counts of the total like histogram does.
+func (h *histogram32) Aggregate(roll int, samples []metric) {
+	h.Lock()
+	defer h.Unlock()
+	h.touch()
+	decay := math.Pow(1-2/float64(len(samples)+1), float64(roll))
+	for i := range h.bins {
+		h.bins[i].count = float32(float64(h.bins[i].count) * decay)
+	}
+}
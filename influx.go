@@ -0,0 +1,223 @@
+package metric
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteInflux writes metrics in InfluxDB line protocol, one line per metric
+// with the metric name as measurement and numeric fields of its JSON
+// representation as fields, e.g. "latency,host=a p50=0.1,p90=0.3,p99=0.5".
+// Timelines are reported by their totals, like in WritePrometheus. Tags are
+// added to each line, the timestamp is written in nanoseconds.
+func WriteInflux(w io.Writer, metrics map[string]Metric, tags map[string]string, t time.Time) error {
+	names := []string{}
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tagset := ""
+	for _, k := range keys {
+		tagset += "," + influxEscape(k, ", =") + "=" + influxEscape(tags[k], ", =")
+	}
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		b, err := json.Marshal(metrics[name])
+		if err != nil {
+			return err
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		m = current(m)
+		fields := []string{}
+		for k, v := range m {
+			if f, ok := v.(float64); ok {
+				fields = append(fields, influxEscape(k, ", =")+"="+strconv.FormatFloat(f, 'g', -1, 64))
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(bw, "%s%s %s %d\n", influxEscape(name, ", "), tagset, strings.Join(fields, ","), t.UnixNano())
+	}
+	return bw.Flush()
+}
+
+// influxEscape escapes the special characters with backslashes.
+func influxEscape(s, special string) string {
+	for _, c := range special {
+		s = strings.Replace(s, string(c), `\`+string(c), -1)
+	}
+	return s
+}
+
+// InfluxOptions configures pushing metrics to InfluxDB with NewInflux.
+type InfluxOptions struct {
+	// Interval between pushes, one minute by default.
+	Interval time.Duration
+	// Timeout of a single push, the push interval by default.
+	Timeout time.Duration
+	// Tags added to all metrics, e.g. host name.
+	Tags map[string]string
+}
+
+// Influx pushes metrics to InfluxDB periodically.
+type Influx struct {
+	addr     *url.URL
+	snapshot func() map[string]Metric
+	opts     InfluxOptions
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{}
+	done     chan struct{}
+	closing  sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// maxPacket limits the size of UDP datagrams to avoid fragmentation.
+const maxPacket = 1400
+
+// NewInflux starts pushing the metrics returned by snapshot to InfluxDB. The
+// address is either an HTTP write endpoint, e.g.
+// "http://localhost:8086/write?db=metrics", or a UDP listener, e.g.
+// "udp://localhost:8089". Push errors don't stop pushing, the last one is
+// reported by Err. Pushes that take longer than the timeout are abandoned. Call
+// Close to stop pushing and Flush to push immediately.
+func NewInflux(addr string, snapshot func() map[string]Metric, opts InfluxOptions) (*Influx, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" {
+		return nil, fmt.Errorf("metric: unsupported influx address %q", addr)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = opts.Interval
+	}
+	in := &Influx{addr: u, snapshot: snapshot, opts: opts, client: &http.Client{Timeout: opts.Timeout},
+		stop: make(chan struct{}), done: make(chan struct{})}
+	in.ctx, in.cancel = context.WithCancel(context.Background())
+	go in.run()
+	return in, nil
+}
+
+func (in *Influx) run() {
+	defer close(in.done)
+	ticker := time.NewTicker(in.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-in.stop:
+			return
+		case <-ticker.C:
+			in.Flush()
+		}
+	}
+}
+
+// Flush sends the current state of the metrics immediately, e.g. before
+// Close on shutdown, and returns the error, which is also reported by Err.
+// It doesn't affect the periodic pushes.
+func (in *Influx) Flush() error {
+	buf := &bytes.Buffer{}
+	err := WriteInflux(buf, in.snapshot(), in.opts.Tags, now())
+	if err == nil && buf.Len() > 0 {
+		if in.addr.Scheme == "udp" {
+			err = in.sendUDP(buf.Bytes())
+		} else {
+			err = in.sendHTTP(buf)
+		}
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.err = err
+	return err
+}
+
+func (in *Influx) sendHTTP(body io.Reader) error {
+	req, err := http.NewRequestWithContext(in.ctx, "POST", in.addr.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res, err := in.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("metric: influx responded with %s", res.Status)
+	}
+	return nil
+}
+
+// sendUDP sends the lines in datagrams of up to maxPacket bytes, never
+// splitting a line.
+func (in *Influx) sendUDP(b []byte) error {
+	conn, err := net.Dial("udp", in.addr.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(in.opts.Timeout))
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPacket {
+			if i := bytes.LastIndexByte(b[:maxPacket], '\n'); i >= 0 {
+				n = i + 1
+			} else if i := bytes.IndexByte(b, '\n'); i >= 0 {
+				n = i + 1
+			}
+		}
+		if _, err := conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Err returns the error of the last push, or nil if it succeeded.
+func (in *Influx) Err() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.err
+}
+
+// Close stops pushing metrics, abandoning a push in progress. It's safe to
+// call several times, later calls return the same result as the first one.
+func (in *Influx) Close() error {
+	in.closing.Do(func() {
+		in.cancel()
+		close(in.stop)
+		<-in.done
+	})
+	return nil
+}
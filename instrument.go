@@ -0,0 +1,120 @@
+package metric
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Instrument returns an http.Handler that measures requests served by h and
+// publishes the following metrics with the given frames:
+//
+//	name:count    - counter of requests
+//	name:latency  - duration histogram of the response time in seconds
+//	name:inflight - gauge of requests being served concurrently
+//	name:2xx etc. - counters of responses by status class, published lazily
+//
+// Handlers that panic are counted as 5xx, the panic is passed on.
+//
+// Metrics are published with GetOrPublish, so the same name may be used for
+// several handlers to get combined metrics.
+func Instrument(name string, h http.Handler, frames ...string) http.Handler {
+	return instrument(GetOrPublish, name, h, frames...)
+}
+
+func instrument(publish func(string, func() Metric) Metric, name string, h http.Handler, frames ...string) http.Handler {
+	count := publish(name+":count", func() Metric { return NewCounter(frames...) })
+	latency := publish(name+":latency", func() Metric { return NewDurationHistogram(frames...) })
+	inflight := publish(name+":inflight", func() Metric { return NewGauge(frames...) })
+	// Status class counters are indexed by status/100, net/http only allows
+	// status codes from 100 to 999
+	var (
+		classes [10]Metric
+		once    [10]sync.Once
+	)
+	class := func(i int) Metric {
+		once[i].Do(func() {
+			classes[i] = publish(fmt.Sprintf("%s:%dxx", name, i), func() Metric { return NewCounter(frames...) })
+		})
+		return classes[i]
+	}
+	var n int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		count.Add(1)
+		inflight.Add(float64(atomic.AddInt64(&n, 1)))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		served := false
+		defer func() {
+			inflight.Add(float64(atomic.AddInt64(&n, -1)))
+			latency.Add(time.Since(start).Seconds())
+			i := sw.status / 100
+			if !served || i < 1 || i >= len(classes) {
+				i = 5
+			}
+			class(i).Add(1)
+		}()
+		h.ServeHTTP(sw, r)
+		served = true
+	})
+}
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher if the underlying writer supports it.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer supports it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("metric: %T does not support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Result returns a function that adds 1 to ok if the error passed to it is
+// nil, or to fail otherwise, e.g.
+//
+//	done := Result(saved, failed)
+//	done(db.Save(record))
+func Result(ok, fail Metric) func(err error) {
+	return func(err error) {
+		if err != nil {
+			fail.Add(1)
+		} else {
+			ok.Add(1)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package metric
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalMinCompact is the minimal number of records appended before the
+// journal is compacted.
+const journalMinCompact = 1024
+
+// Journal is a metric that appends each added value with its time to a file,
+// a write-ahead log, so that the metric timelines survive restarts.
+type Journal struct {
+	Metric
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// kept is the number of records left by the last compaction, written is
+	// the number of records appended since then
+	kept, written int
+}
+
+// OpenJournal replays the values recorded in the file at the given path into
+// the metric with AddAt, so that they land in the samples they were observed
+// in, and returns the metric that appends all further values to the file:
+//
+//	latency, err := OpenJournal("latency.wal", NewHistogram("15m10s", "1h1m"))
+//
+// Values older than the longest timeline are dropped from the file each time
+// it doubles in size, so it never grows much beyond the metric window. Each
+// value is written with a single write call, but the file is only synced on
+// Close, so the values of the last moments before a crash may be lost. A
+// partially written last record is ignored. The metric must have frames and
+// shouldn't be used directly afterwards, or the values won't be recorded.
+func OpenJournal(path string, m Metric) (*Journal, error) {
+	if _, ok := m.(interface{ AddAt(float64, time.Time) }); !ok {
+		return nil, errors.New("metric: only metrics with frames can be journaled")
+	}
+	j := &Journal{Metric: m, path: path}
+	records, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		m.(interface{ AddAt(float64, time.Time) }).AddAt(r.value, r.t)
+	}
+	if err := j.compact(records); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// record is a single value of the journal with the time it was added.
+type record struct {
+	t     time.Time
+	value float64
+}
+
+// horizon returns the duration of the longest metric timeline.
+func (j *Journal) horizon() time.Duration {
+	switch m := j.Metric.(type) {
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		return m.span()
+	case multimetric:
+		var d time.Duration
+		for _, ts := range m {
+			ts.Lock()
+			if ts.span() > d {
+				d = ts.span()
+			}
+			ts.Unlock()
+		}
+		return d
+	}
+	return 0
+}
+
+// read returns all records of the journal file, or none if it doesn't exist.
+func (j *Journal) read() ([]record, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ns, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		records = append(records, record{time.Unix(0, ns), value})
+	}
+	return records, s.Err()
+}
+
+// compact replaces the journal file with the records within the metric
+// horizon and opens it for appending.
+func (j *Journal) compact(records []record) error {
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	since := now().Add(-j.horizon())
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	kept := 0
+	for _, r := range records {
+		if r.t.After(since) {
+			w.Write(formatRecord(r))
+			kept++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	if j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	j.kept, j.written = kept, 0
+	return nil
+}
+
+func formatRecord(r record) []byte {
+	b := strconv.AppendInt(nil, r.t.UnixNano(), 10)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, r.value, 'g', -1, 64)
+	return append(b, '\n')
+}
+
+// Add records the value in the journal and adds it to the metric. Errors
+// writing the journal are ignored, the value is added to the metric anyway.
+func (j *Journal) Add(n float64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	t := now()
+	j.Metric.Add(n)
+	if j.f == nil {
+		return
+	}
+	j.f.Write(formatRecord(record{t, n}))
+	j.written++
+	if j.written > j.kept && j.written >= journalMinCompact {
+		if records, err := j.read(); err == nil {
+			j.compact(records)
+		}
+	}
+}
+
+// Reset resets the metric and clears the journal.
+func (j *Journal) Reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	resetMetric(j.Metric)
+	j.compact(nil)
+}
+
+func (j *Journal) unwrap() Metric { return j.Metric }
+
+func (j *Journal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Metric)
+}
+
+// Close syncs and closes the journal file. The metric can still be used, but
+// the values are no longer recorded.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Sync()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	j.f = nil
+	return err
+}
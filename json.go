@@ -0,0 +1,139 @@
+package metric
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CounterJSON is the JSON representation of a counter.
+type CounterJSON struct {
+	Type  string  `json:"type"`
+	Count float64 `json:"count"`
+	// Overflow is set if some increments have been lost, because the count
+	// became too large for the float64 precision.
+	Overflow bool      `json:"overflow,omitempty"`
+	Meta     *MetaJSON `json:"_meta,omitempty"`
+}
+
+// GaugeJSON is the JSON representation of a gauge.
+type GaugeJSON struct {
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	// Up and Down are only reported if GaugeOptions.Churn is set.
+	Up   *int `json:"up,omitempty"`
+	Down *int `json:"down,omitempty"`
+	// Status is only reported if GaugeOptions.Threshold is set.
+	Status string    `json:"status,omitempty"`
+	Meta   *MetaJSON `json:"_meta,omitempty"`
+}
+
+// HistogramJSON is the JSON representation of a histogram. Duration strings
+// are only reported by duration histograms.
+type HistogramJSON struct {
+	Type string  `json:"type"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	// Mean is the weighted mean of the bins, which is exact unless bins have
+	// been merged. It's always present, since 0 is a valid mean, e.g. of -1
+	// and 1.
+	Mean   float64 `json:"mean"`
+	P50Str string  `json:"p50_str,omitempty"`
+	P90Str string  `json:"p90_str,omitempty"`
+	P99Str string  `json:"p99_str,omitempty"`
+	// P50Err, P90Err and P99Err are the widths of the bins the quantiles come
+	// from, i.e. how far off the quantiles may be. They are left out while a
+	// histogram with HistogramOptions.Exact keeps all observed values.
+	P50Err float64   `json:"p50_err,omitempty"`
+	P90Err float64   `json:"p90_err,omitempty"`
+	P99Err float64   `json:"p99_err,omitempty"`
+	Meta   *MetaJSON `json:"_meta,omitempty"`
+}
+
+// TimelineJSON is the JSON representation of a metric with a single time
+// frame. Total and samples can be decoded into the JSON type of the underlying
+// metric, e.g. CounterJSON. Samples are ordered newest first, so the current
+// sample is always the first one, unless OldestFirst is set. Partial is the
+// index of the partial sample in the same order.
+type TimelineJSON struct {
+	Interval float64           `json:"interval"`
+	Total    json.RawMessage   `json:"total"`
+	Samples  []json.RawMessage `json:"samples"`
+	Partial  *int              `json:"partial,omitempty"`
+	// First and Last are the unix times of the earliest and the latest value
+	// added to the samples still in the timeline. They are only reported when
+	// Verbose is set and some values were added.
+	First int64 `json:"first,omitempty"`
+	Last  int64 `json:"last,omitempty"`
+}
+
+// Point is a single point of a series returned by Series.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// MetaJSON holds diagnostic fields reported when Verbose is set.
+type MetaJSON struct {
+	Resets    uint64 `json:"resets"`
+	LastReset int64  `json:"last_reset,omitempty"`
+}
+
+// PlainFloats makes metrics format all numbers in JSON as plain decimals,
+// e.g. 0.0000001 instead of 1e-07, for consumers that can't parse the
+// exponent notation. It should be set before any metrics are marshaled.
+var PlainFloats = false
+
+// marshal returns JSON encoding of a metric value, respecting PlainFloats.
+func marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || !PlainFloats {
+		return b, err
+	}
+	return plainFloats(b), nil
+}
+
+// plainFloats rewrites all numbers in exponent notation in the JSON-encoded
+// data as plain decimals.
+func plainFloats(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == '"' {
+			j := i + 1
+			for ; j < len(b) && b[j] != '"'; j++ {
+				if b[j] == '\\' {
+					j++
+				}
+			}
+			out = append(out, b[i:j+1]...)
+			i = j
+			continue
+		}
+		if c != '-' && (c < '0' || c > '9') {
+			out = append(out, c)
+			continue
+		}
+		j := i
+		for j < len(b) && strings.IndexByte("0123456789+-.eE", b[j]) >= 0 {
+			j++
+		}
+		num := b[i:j]
+		if bytes.IndexAny(num, "eE") >= 0 {
+			if f, err := strconv.ParseFloat(string(num), 64); err == nil {
+				num = strconv.AppendFloat(nil, f, 'f', -1, 64)
+			}
+		}
+		out = append(out, num...)
+		i = j - 1
+	}
+	return out
+}
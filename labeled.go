@@ -0,0 +1,113 @@
+package metric
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labeled is a metric that keeps a separate child metric for each distinct
+// set of labels, similar to Prometheus label vectors.
+type Labeled interface {
+	Metric
+	AddLabeled(n float64, labels map[string]string)
+}
+
+// NewLabeled returns a labeled metric that builds a new child metric with the
+// given function for each distinct set of labels, e.g.
+//
+//	requests := NewLabeled(func() Metric { return NewCounter("15m10s") })
+//	requests.AddLabeled(1, map[string]string{"method": "GET", "code": "200"})
+//
+// Add is the same as AddLabeled without labels. Each label set keeps its own
+// metric forever, so labels should have a small number of distinct values.
+func NewLabeled(build func() Metric) Labeled {
+	return &labeled{build: build, children: map[string]*labeledChild{}}
+}
+
+type labeledChild struct {
+	labels map[string]string
+	metric Metric
+}
+
+type labeled struct {
+	mu       sync.RWMutex
+	build    func() Metric
+	children map[string]*labeledChild
+}
+
+// labelKey returns a canonical representation of a label set, e.g.
+// `code="200",method="GET"`.
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l *labeled) child(labels map[string]string) Metric {
+	key := labelKey(labels)
+	l.mu.RLock()
+	c, ok := l.children[key]
+	l.mu.RUnlock()
+	if ok {
+		return c.metric
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.children[key]; ok {
+		return c.metric
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	c = &labeledChild{labels: copied, metric: l.build()}
+	l.children[key] = c
+	return c.metric
+}
+
+func (l *labeled) AddLabeled(n float64, labels map[string]string) {
+	l.child(labels).Add(n)
+}
+
+func (l *labeled) Add(n float64) {
+	l.AddLabeled(n, nil)
+}
+
+// MarshalJSON returns the child metrics with their labels, ordered by the
+// label sets.
+func (l *labeled) MarshalJSON() ([]byte, error) {
+	type child struct {
+		Labels map[string]string `json:"labels"`
+		Metric Metric            `json:"metric"`
+	}
+	l.mu.RLock()
+	keys := make([]string, 0, len(l.children))
+	for key := range l.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]child, len(keys))
+	for i, key := range keys {
+		children[i] = child{l.children[key].labels, l.children[key].metric}
+	}
+	l.mu.RUnlock()
+	return json.Marshal(struct {
+		Type     string  `json:"type"`
+		Children []child `json:"children"`
+	}{"labeled", children})
+}
+
+func (l *labeled) String() string {
+	b, _ := l.MarshalJSON()
+	return string(b)
+}
@@ -1,11 +1,16 @@
 package metric
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"math"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,6 +19,90 @@ import (
 // To mock time in tests
 var now = time.Now
 
+// Verbose enables diagnostic "_meta" fields (reset count and last reset time)
+// in the JSON output of counters, gauges and histograms, and the "first" and
+// "last" add times of timelines. It should be set before any metrics are
+// marshaled.
+var Verbose = false
+
+// Logger receives warnings about suspicious usage, e.g. frames that keep a
+// single sample. Set it to nil to silence the warnings.
+var Logger = log.New(os.Stderr, "metric: ", log.LstdFlags)
+
+// OldestFirst makes timelines marshal their samples in chronological order,
+// which is what most charting libraries expect. By default samples are
+// ordered newest first. It should be set before any metrics are marshaled.
+var OldestFirst = false
+
+// SelfMetrics enables measuring the time spent in Add calls of timeline
+// metrics, see SelfStats. It is disabled by default to avoid any overhead.
+var SelfMetrics = false
+
+var self = &histogram{}
+
+func selfTime(start time.Time) {
+	self.Add(time.Since(start).Seconds())
+}
+
+// SelfStats returns a histogram of the time in seconds spent in Add calls of
+// timeline metrics, recorded while SelfMetrics is enabled.
+func SelfStats() Metric {
+	return self
+}
+
+// versions is a global sequence of observed metric changes. A metric takes the
+// next number from it when its version is read after a change, so that changes
+// of all metrics are ordered and a single number describes the state of any set
+// of metrics, while Add only touches the metric itself.
+var versions uint64
+
+// meta keeps diagnostic bookkeeping common to all metric types.
+type meta struct {
+	resets    uint64
+	lastReset int64
+	changes   uint64
+	seen      uint64
+	ver       uint64
+}
+
+func (m *meta) reset() {
+	atomic.AddUint64(&m.resets, 1)
+	atomic.StoreInt64(&m.lastReset, now().UnixNano())
+	m.touch()
+}
+
+// touch marks the metric as changed.
+func (m *meta) touch() {
+	atomic.AddUint64(&m.changes, 1)
+}
+
+// version returns the sequence number of the last change of the metric, or 0
+// if it has never changed. Changes made since the previous call get a new
+// number from versions.
+func (m *meta) version() uint64 {
+	n := atomic.LoadUint64(&m.changes)
+	if n == 0 {
+		return 0
+	}
+	if atomic.LoadUint64(&m.seen) != n {
+		atomic.StoreUint64(&m.ver, atomic.AddUint64(&versions, 1))
+		atomic.StoreUint64(&m.seen, n)
+	}
+	return atomic.LoadUint64(&m.ver)
+}
+
+// meta returns diagnostic fields to be marshaled, or nil unless Verbose is set.
+func (m *meta) meta() *MetaJSON {
+	if !Verbose {
+		return nil
+	}
+	mj := &MetaJSON{Resets: atomic.LoadUint64(&m.resets)}
+	if t := atomic.LoadInt64(&m.lastReset); t != 0 {
+		mj.LastReset = time.Unix(0, t).Unix()
+	}
+	return mj
+}
+
 // Metric is a single meter (counter, gauge or histogram, optionally - with history)
 type Metric interface {
 	Add(n float64)
@@ -26,9 +115,119 @@ type metric interface {
 	Metric
 	Reset()
 	Aggregate(roll int, samples []metric)
+	version() uint64
+}
+
+// versioned is implemented by metrics that keep track of their changes, see
+// the ETag support in Handler and JSONHandler.
+type versioned interface {
+	version() uint64
 }
 
-var _, _, _ metric = &counter{}, &gauge{}, &histogram{}
+// wrapper is implemented by the metric wrappers of this package, like Scaled
+// or OmitEmpty, to give access to the wrapped metric.
+type wrapper interface {
+	unwrap() Metric
+}
+
+// walk calls visit with the metric and then with each metric it wraps, from
+// the outermost one, until visit returns true or there's nothing to unwrap.
+func walk(m Metric, visit func(m Metric) bool) {
+	for !visit(m) {
+		w, ok := m.(wrapper)
+		if !ok {
+			return
+		}
+		m = w.unwrap()
+	}
+}
+
+// versionOf returns the version of the metric, looking through the wrappers
+// of this package, or false if the metric does not keep track of changes.
+func versionOf(m Metric) (v uint64, ok bool) {
+	walk(m, func(m Metric) bool {
+		if a, isAutoReset := m.(*autoReset); isAutoReset {
+			a.check()
+		}
+		if vm, isVersioned := m.(versioned); isVersioned {
+			v, ok = vm.version(), true
+		}
+		return ok
+	})
+	return v, ok
+}
+
+// resetMetric resets the metric, looking through the wrappers of this
+// package. Metrics without a Reset method are left as is.
+func resetMetric(m Metric) {
+	walk(m, func(m Metric) bool {
+		r, ok := m.(interface{ Reset() })
+		if ok {
+			r.Reset()
+		}
+		return ok
+	})
+}
+
+var _, _, _, _, _, _, _, _, _, _, _, _ metric = &counter{}, &gauge{}, &meanGauge{}, &histogram{}, &derivative{},
+	&psquare{}, &heatmap{}, &ddsketch{}, &histogram32{}, &rateCounter{}, &acceleration{}, &availability{}
+
+// carrier is implemented by metrics that depend on the previous observations,
+// so that a freshly rolled timeline sample can pick up where the previous
+// sample left off.
+type carrier interface {
+	carry(prev metric)
+}
+
+// Histogram is a Metric that also accepts weighted observations, e.g. values
+// that have been pre-aggregated into (value, frequency) pairs. Histograms and
+// histogram timelines returned by NewHistogram implement it.
+type Histogram interface {
+	Metric
+	AddWeighted(value, weight float64)
+	AddPairs(pairs []Bin)
+	// Quantile returns the value below which the fraction q of observations
+	// fall. The fraction is clamped to [0, 1], so that e.g. Quantile(2) is
+	// the maximum, NaN returns NaN.
+	Quantile(q float64) float64
+	// Rank returns the fraction of observations less than or equal to the
+	// value, the inverse of Quantile, e.g. Rank(0.1) of a latency histogram
+	// is the share of requests served within 100ms.
+	Rank(value float64) float64
+	// Mode returns the value of the bin with the most observations, e.g. to
+	// spot the peaks of a multimodal distribution, or 0 if it's empty.
+	Mode() float64
+}
+
+// clampQuantile limits the quantile fraction to [0, 1], keeping NaN.
+func clampQuantile(q float64) float64 {
+	if q < 0 {
+		return 0
+	} else if q > 1 {
+		return 1
+	}
+	return q
+}
+
+var _, _, _, _, _ Histogram = &histogram{}, &timeseries{}, multimetric{}, &ddsketch{}, &histogram32{}
+
+// mode returns the value of the bin with the highest count, the lowest one
+// if there are several.
+func mode(bins []Bin) float64 {
+	best := Bin{}
+	for _, b := range bins {
+		if b.Count > best.Count || (b.Count == best.Count && b.Count > 0 && b.Value < best.Value) {
+			best = b
+		}
+	}
+	return best.Value
+}
+
+// IQR returns the interquartile range of the histogram, i.e. the difference
+// between its 75th and 25th percentiles, a spread measure robust to outliers.
+func IQR(h Histogram) float64 {
+	return h.Quantile(0.75) - h.Quantile(0.25)
+}
 
 // NewCounter returns a counter metric that increments the value with each
 // incoming number.
@@ -36,10 +235,113 @@ func NewCounter(frames ...string) Metric {
 	return newMetric(func() metric { return &counter{} }, frames...)
 }
 
+// NewCounterE is like NewCounter, but returns the error of the first invalid
+// frame (see ValidateFrames) instead of replacing it with defaults.
+func NewCounterE(frames ...string) (Metric, error) {
+	if err := ValidateFrames(frames...); err != nil {
+		return nil, err
+	}
+	return NewCounter(frames...), nil
+}
+
 // NewGauge returns a gauge metric that sums up the incoming values and returns
-// mean/min/max of the resulting distribution.
+// mean/min/max of the resulting distribution. Gauges without frames can also
+// be reset softly with ResetSoft(), which keeps the last value as a baseline
+// for min and max.
 func NewGauge(frames ...string) Metric {
-	return newMetric(func() metric { return &gauge{} }, frames...)
+	return NewGaugeWith(GaugeOptions{}, frames...)
+}
+
+// NewGaugeE is like NewGauge, but returns the error of the first invalid
+// frame (see ValidateFrames) instead of replacing it with defaults.
+func NewGaugeE(frames ...string) (Metric, error) {
+	if err := ValidateFrames(frames...); err != nil {
+		return nil, err
+	}
+	return NewGauge(frames...), nil
+}
+
+// GaugeOptions configures gauges created with NewGaugeWith.
+type GaugeOptions struct {
+	// Aggregation defines how the reported mean is calculated, arithmetic
+	// mean is used by default.
+	Aggregation Aggregation
+	// Churn enables counting how many times the value went up and down
+	// between consecutive values, reported as "up" and "down".
+	Churn bool
+	// Initial, if set, is reported as value, mean, min and max until the
+	// first value is added, and again after each Reset, instead of zeros.
+	Initial *float64
+	// Threshold, if set, adds the "status" of the current value to the JSON.
+	Threshold *Threshold
+}
+
+// Threshold defines the alert levels of a gauge value. The status is "crit"
+// when the value reaches Crit, "warn" when it reaches Warn and "ok"
+// otherwise. If Crit is below Warn lower values are considered worse, e.g.
+// for the free disk space.
+type Threshold struct {
+	Warn float64
+	Crit float64
+}
+
+func (t *Threshold) status(x float64) string {
+	worse := func(a, b float64) bool { return a >= b }
+	if t.Crit < t.Warn {
+		worse = func(a, b float64) bool { return a <= b }
+	}
+	switch {
+	case worse(x, t.Crit):
+		return "crit"
+	case worse(x, t.Warn):
+		return "warn"
+	}
+	return "ok"
+}
+
+// NewGaugeWith returns a gauge metric like NewGauge, configured with the
+// given options.
+func NewGaugeWith(opts GaugeOptions, frames ...string) Metric {
+	return newMetric(func() metric {
+		g := &gauge{opts: opts}
+		g.init()
+		return g
+	}, frames...)
+}
+
+// Aggregation defines how a gauge calculates its mean: each value is
+// transformed with Map before summing up, and the average of the transformed
+// values is transformed back with Inverse. Nil functions keep values as is.
+type Aggregation struct {
+	Map     func(float64) float64
+	Inverse func(float64) float64
+}
+
+var (
+	// ArithmeticMean is the default gauge aggregation.
+	ArithmeticMean = Aggregation{}
+	// GeometricMean is the n-th root of the product of n values, e.g. for
+	// averaging growth rates. Values must be positive.
+	GeometricMean = Aggregation{Map: math.Log, Inverse: math.Exp}
+	// HarmonicMean is the reciprocal of the mean of reciprocals, e.g. for
+	// averaging rates over equal amounts of work. Values must be non-zero.
+	HarmonicMean = Aggregation{Map: reciprocal, Inverse: reciprocal}
+)
+
+func reciprocal(x float64) float64 { return 1 / x }
+
+func (a Aggregation) mapValue(x float64) float64 {
+	if a.Map == nil {
+		return x
+	}
+	return a.Map(x)
+}
+
+func (a Aggregation) inverse(x float64) float64 {
+	if a.Inverse == nil {
+		return x
+	}
+	return a.Inverse(x)
 }
 
 // NewHistogram returns a histogram metric that calculates 50%, 90% and 99%
@@ -48,170 +350,1422 @@ func NewHistogram(frames ...string) Metric {
 	return newMetric(func() metric { return &histogram{} }, frames...)
 }
 
+// NewHistogramE is like NewHistogram, but returns the error of the first
+// invalid frame (see ValidateFrames) instead of replacing it with defaults.
+func NewHistogramE(frames ...string) (Metric, error) {
+	if err := ValidateFrames(frames...); err != nil {
+		return nil, err
+	}
+	return NewHistogram(frames...), nil
+}
+
+// HistogramOptions configures histograms created with NewHistogramWith.
+type HistogramOptions struct {
+	// Exact, if positive, keeps all observed values as long as there are no
+	// more than Exact distinct ones, so that percentiles of low-volume metrics
+	// are exact. Once exceeded, values are merged into approximate bins as
+	// usual until the histogram is reset.
+	Exact int
+	// LogScale bins values by their logarithm, so that the resolution is the
+	// same relative to the value across orders of magnitude, which suits
+	// log-normally distributed data like latencies. Non-positive values are
+	// ignored.
+	LogScale bool
+	// KeepBins makes Reset zero the bin counts but keep the bin values, so that
+	// timeline samples of a stable distribution don't rebuild the same bins
+	// on each roll. Once all bins are in use, values are counted in the nearest
+	// bin instead of being merged, so bins stop adapting to the distribution.
+	KeepBins bool
+	// Method defines how quantiles are estimated from the bins, QuantileBin
+	// by default.
+	Method QuantileMethod
+}
+
+// QuantileMethod is a definition of quantiles, so that they can match the
+// ones of other tools. All methods treat a bin with value v and count c as c
+// observations equal to v.
+type QuantileMethod int
+
+const (
+	// QuantileBin returns the value of the first bin where the cumulative
+	// count reaches q*N, N being the total count.
+	QuantileBin QuantileMethod = iota
+	// QuantileNearestRank returns the value of the observation with the
+	// 1-based rank ceil(q*N), but at least 1. It only differs from QuantileBin
+	// when counts are fractional, e.g. after timeline decay or AddWeighted.
+	QuantileNearestRank
+	// QuantileLinear interpolates linearly between the observations with the
+	// 0-based ranks floor(h) and ceil(h), where h = q*(N-1), like numpy's
+	// default percentile or Excel's PERCENTILE.INC.
+	QuantileLinear
+)
+
+// NewHistogramWith returns a histogram metric like NewHistogram, configured
+// with the given options.
+func NewHistogramWith(opts HistogramOptions, frames ...string) Metric {
+	return newMetric(func() metric { return &histogram{opts: opts} }, frames...)
+}
+
+// NewMeanGauge returns a gauge metric that only keeps track of the mean of
+// the incoming values. It is cheaper than NewGauge when min, max and the last
+// value are not needed.
+func NewMeanGauge(frames ...string) Metric {
+	return newMetric(func() metric { return &meanGauge{} }, frames...)
+}
+
+// NewDerivative returns a metric that reports the rate of change of the
+// incoming absolute values per second, e.g. bytes per second given the total
+// number of bytes allocated so far. The first value only establishes a
+// baseline, so the rate is 0 until the second value arrives.
+func NewDerivative(frames ...string) Metric {
+	return newMetric(func() metric { return &derivative{} }, frames...)
+}
+
+// NewHistogramFromBins returns a histogram metric initialized with the given
+// bins, e.g. restored from a persisted state. Bins with non-positive counts are
+// ignored.
+func NewHistogramFromBins(bins []Bin) Histogram {
+	h := &histogram{}
+	for _, b := range bins {
+		if b.Count > 0 {
+			h.bins = append(h.bins, b)
+			h.total = h.total + b.Count
+			h.compact(false)
+		}
+	}
+	h.compact(true)
+	return h
+}
+
+// NewDurationHistogram returns a histogram metric for durations measured in
+// seconds. In addition to the numeric percentiles it reports them as
+// human-readable duration strings, e.g. "12ms" or "1.3s".
+func NewDurationHistogram(frames ...string) Metric {
+	return newMetric(func() metric { return &histogram{duration: true} }, frames...)
+}
+
 type timeseries struct {
-	sync.Mutex
+	sync.RWMutex
 	now      time.Time
+	start    time.Time
 	size     int
 	interval time.Duration
 	total    metric
 	samples  []metric
+	builder  func() metric
+	onRoll   func(rolled int, now time.Time)
+	// used is set once the first value is added, see Live
+	used uint32
+	// totalFn, if set, replaces the reported total, see TotalFunc
+	totalFn func(samples []Metric) float64
+	// stamps keep the first and last add time of each sample
+	stamps []stamp
+}
+
+// stamp records the times of the first and the last value added to a sample,
+// in nanoseconds, or zero if nothing was added.
+type stamp struct {
+	first int64
+	last  int64
+}
+
+// mark updates the stamp with the given time. It's safe for concurrent use.
+func (st *stamp) mark(t int64) {
+	for {
+		first := atomic.LoadInt64(&st.first)
+		if (first != 0 && first <= t) || atomic.CompareAndSwapInt64(&st.first, first, t) {
+			break
+		}
+	}
+	for {
+		last := atomic.LoadInt64(&st.last)
+		if last >= t || atomic.CompareAndSwapInt64(&st.last, last, t) {
+			break
+		}
+	}
+}
+
+// window returns the first and the last add time over all samples.
+func (ts *timeseries) window() (first, last int64) {
+	for i := range ts.stamps {
+		f, l := atomic.LoadInt64(&ts.stamps[i].first), atomic.LoadInt64(&ts.stamps[i].last)
+		if f != 0 && (first == 0 || f < first) {
+			first = f
+		}
+		if l > last {
+			last = l
+		}
+	}
+	return first, last
+}
+
+// bucket returns the start time of the sample interval that t belongs to.
+// Samples are centered around the multiples of the interval, i.e. t belongs to
+// the sample of t.Round(interval).
+func (ts *timeseries) bucket(t time.Time) time.Time {
+	return t.Round(ts.interval).Add(-ts.interval / 2)
+}
+
+// partial returns the index of the sample that covered less than half of its
+// interval because the timeline was created or reset after the time the
+// sample is centered around, or -1 if there is no such sample within the
+// window.
+func (ts *timeseries) partial() int {
+	if !ts.start.After(ts.start.Round(ts.interval)) {
+		return -1
+	}
+	i := int(ts.bucket(ts.now).Sub(ts.bucket(ts.start)) / ts.interval)
+	if i >= len(ts.samples) {
+		return -1
+	}
+	return i
+}
+
+// span returns the total duration covered by the timeline.
+func (ts *timeseries) span() time.Duration {
+	return ts.interval * time.Duration(len(ts.samples))
+}
+
+func (ts *timeseries) Reset() {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.now = now()
+	ts.start = ts.now
+	ts.reset()
+}
+
+func (ts *timeseries) reset() {
+	ts.total.Reset()
+	for _, s := range ts.samples {
+		s.Reset()
+	}
+	for i := range ts.stamps {
+		ts.stamps[i] = stamp{}
+	}
+}
+
+func (ts *timeseries) roll() {
+	t := now()
+	roll := int(ts.bucket(t).Sub(ts.bucket(ts.now)) / ts.interval)
+	ts.now = t
+	n := len(ts.samples)
+	if roll <= 0 {
+		return
+	}
+	if ts.onRoll != nil {
+		ts.onRoll(roll, t)
+	}
+	if roll >= len(ts.samples) {
+		ts.reset()
+	} else {
+		for i := 0; i < roll; i++ {
+			tmp := ts.samples[n-1]
+			for j := n - 1; j > 0; j-- {
+				ts.samples[j] = ts.samples[j-1]
+			}
+			ts.samples[0] = tmp
+			ts.samples[0].Reset()
+			copy(ts.stamps[1:], ts.stamps)
+			ts.stamps[0] = stamp{}
+			if c, ok := ts.samples[0].(carrier); ok && n > 1 {
+				c.carry(ts.samples[1])
+			}
+		}
+		ts.total.Aggregate(roll, ts.samples)
+	}
+}
+
+func (ts *timeseries) Add(n float64) {
+	if SelfMetrics {
+		defer selfTime(time.Now())
+	}
+	ts.add(n)
+}
+
+func (ts *timeseries) add(n float64) {
+	// Fast path: while the current sample is still current, no roll is needed
+	// and concurrent adds only need a read lock, since samples synchronize
+	// themselves.
+	if atomic.LoadUint32(&ts.used) == 0 {
+		atomic.StoreUint32(&ts.used, 1)
+	}
+	t := now()
+	ts.RLock()
+	if !t.Before(ts.now) && ts.bucket(t).Equal(ts.bucket(ts.now)) {
+		ts.total.Add(n)
+		ts.samples[0].Add(n)
+		ts.stamps[0].mark(t.UnixNano())
+		ts.RUnlock()
+		return
+	}
+	ts.RUnlock()
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	ts.total.Add(n)
+	ts.samples[0].Add(n)
+	ts.stamps[0].mark(ts.now.UnixNano())
+}
+
+// AddAt adds a value as if it was observed at the given time, so that it lands
+// in the matching sample. Values outside of the timeline window, including the
+// ones from the future, are dropped.
+func (ts *timeseries) AddAt(n float64, t time.Time) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	i := int(ts.bucket(ts.now).Sub(ts.bucket(t)) / ts.interval)
+	if t.After(ts.now) || i >= len(ts.samples) {
+		return
+	}
+	atomic.StoreUint32(&ts.used, 1)
+	ts.total.Add(n)
+	ts.samples[i].Add(n)
+	ts.stamps[i].mark(t.UnixNano())
+}
+
+// AddWeighted adds a weighted observation to the timeline if it keeps
+// histograms, otherwise it does nothing.
+func (ts *timeseries) AddWeighted(value, weight float64) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if h, ok := ts.total.(Histogram); ok {
+		atomic.StoreUint32(&ts.used, 1)
+		h.AddWeighted(value, weight)
+		ts.samples[0].(Histogram).AddWeighted(value, weight)
+		ts.stamps[0].mark(ts.now.UnixNano())
+	}
+}
+
+// AddPairs adds a batch of weighted observations to the timeline if it keeps
+// histograms, otherwise it does nothing.
+func (ts *timeseries) AddPairs(pairs []Bin) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if h, ok := ts.total.(Histogram); ok {
+		atomic.StoreUint32(&ts.used, 1)
+		h.AddPairs(pairs)
+		ts.samples[0].(Histogram).AddPairs(pairs)
+		ts.stamps[0].mark(ts.now.UnixNano())
+	}
+}
+
+// Quantile returns the quantile of the timeline total if it keeps histograms,
+// otherwise 0.
+func (ts *timeseries) Quantile(q float64) float64 {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if h, ok := ts.total.(Histogram); ok {
+		return h.Quantile(q)
+	}
+	return 0
+}
+
+func (ts *timeseries) Rank(value float64) float64 {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if h, ok := ts.total.(Histogram); ok {
+		return h.Rank(value)
+	}
+	return 0
+}
+
+func (ts *timeseries) Mode() float64 {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if h, ok := ts.total.(Histogram); ok {
+		return h.Mode()
+	}
+	return 0
+}
+
+func (ts *timeseries) MarshalJSON() ([]byte, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	var partial *int
+	if i := ts.partial(); i >= 0 {
+		if OldestFirst {
+			i = len(ts.samples) - 1 - i
+		}
+		partial = &i
+	}
+	total, err := json.Marshal(ts.reportedTotal())
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]json.RawMessage, len(ts.samples))
+	for i, s := range ts.samples {
+		j := i
+		if OldestFirst {
+			j = len(ts.samples) - 1 - i
+		}
+		if samples[j], err = json.Marshal(s); err != nil {
+			return nil, err
+		}
+	}
+	tj := TimelineJSON{Interval: float64(ts.interval) / float64(time.Second), Total: total, Samples: samples, Partial: partial}
+	if first, last := ts.window(); Verbose && first != 0 {
+		tj.First, tj.Last = time.Unix(0, first).Unix(), time.Unix(0, last).Unix()
+	}
+	return marshal(tj)
+}
+
+// version returns the version of the timeline total, which changes with each
+// added value and each roll.
+func (ts *timeseries) version() uint64 {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	return ts.total.version()
+}
+
+func (ts *timeseries) String() string {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	return ts.reportedTotal().String()
+}
+
+// reportedTotal returns the total to be marshaled, which is a new metric
+// with the single value returned by totalFn if it is set.
+func (ts *timeseries) reportedTotal() metric {
+	if ts.totalFn == nil {
+		return ts.total
+	}
+	samples := make([]Metric, len(ts.samples))
+	for i, s := range ts.samples {
+		samples[i] = s
+	}
+	total := ts.builder()
+	total.Add(ts.totalFn(samples))
+	return total
+}
+
+type multimetric []*timeseries
+
+func (mm multimetric) Add(n float64) {
+	if SelfMetrics {
+		defer selfTime(time.Now())
+	}
+	for _, m := range mm {
+		m.add(n)
+	}
+}
+
+func (mm multimetric) AddAt(n float64, t time.Time) {
+	for _, m := range mm {
+		m.AddAt(n, t)
+	}
+}
+
+func (mm multimetric) AddWeighted(value, weight float64) {
+	for _, m := range mm {
+		m.AddWeighted(value, weight)
+	}
+}
+
+func (mm multimetric) AddPairs(pairs []Bin) {
+	for _, m := range mm {
+		m.AddPairs(pairs)
+	}
+}
+
+func (mm multimetric) Quantile(q float64) float64 {
+	return mm[len(mm)-1].Quantile(q)
+}
+
+func (mm multimetric) Rank(value float64) float64 {
+	return mm[len(mm)-1].Rank(value)
+}
+
+func (mm multimetric) Mode() float64 {
+	return mm[len(mm)-1].Mode()
+}
+
+func (mm multimetric) Reset() {
+	for _, m := range mm {
+		m.Reset()
+	}
+}
+
+func (mm multimetric) MarshalJSON() ([]byte, error) {
+	b := []byte(`{"metrics":[`)
+	for i, m := range mm {
+		if i != 0 {
+			b = append(b, ',')
+		}
+		x, _ := json.Marshal(m)
+		b = append(b, x...)
+	}
+	b = append(b, ']', '}')
+	return b, nil
+}
+
+func (mm multimetric) version() uint64 {
+	var v uint64
+	for _, m := range mm {
+		if x := m.version(); x > v {
+			v = x
+		}
+	}
+	return v
+}
+
+func (mm multimetric) String() string {
+	return mm[len(mm)-1].String()
+}
+
+// Window returns the timeline of the metric that covers the given lookback
+// duration with the finest resolution, e.g. Window(m, 10*time.Minute) on a
+// metric with "2m1s", "15m30s" and "1h1m" frames returns the "15m30s" one. If
+// no timeline covers the whole duration, the longest one is returned. Metrics
+// with a single frame or without frames are returned as is.
+func Window(m Metric, d time.Duration) Metric {
+	mm, ok := m.(multimetric)
+	if !ok {
+		return m
+	}
+	var best *timeseries
+	for _, ts := range mm {
+		if ts.span() >= d && (best == nil || ts.interval < best.interval) {
+			best = ts
+		}
+	}
+	if best == nil {
+		return mm[len(mm)-1]
+	}
+	return best
+}
+
+// Series returns a chart-ready series of the metric, oldest first, that spans
+// the longest timeline at the finest available resolution: samples of a
+// coarser timeline are only used for the time before the start of the finer
+// ones, so that points never overlap, e.g. with "2m1s" and "1h1m" frames the
+// last two minutes are reported by seconds and the rest of the hour by
+// minutes. Each point is the start of a sample and its value, which is the
+// median for histograms and the value printed by String for other metrics.
+// Metrics without frames return no points.
+func Series(m Metric) []Point {
+	var points []Point
+	for _, r := range stitch(m, func(s Metric) []float64 { return []float64{pointValue(s)} }) {
+		points = append(points, Point{Time: r.start, Value: r.values[0]})
+	}
+	return points
+}
+
+// row holds the values of a timeline sample and the start time of its
+// interval.
+type row struct {
+	start  time.Time
+	values []float64
+}
+
+// stitch returns the values of the samples of all metric timelines, oldest
+// first, as described in Series. The values are returned by fn, which is
+// called with the timeline locked.
+func stitch(m Metric, fn func(s Metric) []float64) []row {
+	var timelines []*timeseries
+	switch m := m.(type) {
+	case *timeseries:
+		timelines = []*timeseries{m}
+	case multimetric:
+		timelines = append(timelines, m...)
+	}
+	sort.Slice(timelines, func(i, j int) bool { return timelines[i].interval < timelines[j].interval })
+	var rows []row
+	var covered time.Time
+	for _, ts := range timelines {
+		ts.Lock()
+		ts.roll()
+		var chunk []row
+		for i, s := range ts.samples {
+			start := ts.bucket(ts.now).Add(-time.Duration(i) * ts.interval)
+			if covered.IsZero() || !start.Add(ts.interval).After(covered) {
+				chunk = append(chunk, row{start, fn(s)})
+			}
+		}
+		if len(chunk) > 0 {
+			covered = chunk[len(chunk)-1].start
+		}
+		ts.Unlock()
+		rows = append(rows, chunk...)
+	}
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+	return rows
+}
+
+func pointValue(m Metric) float64 {
+	if h, ok := m.(Histogram); ok {
+		return h.Quantile(0.5)
+	}
+	x, err := strconv.ParseFloat(m.String(), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return x
+}
+
+// TotalFunc replaces the total reported by the JSON and String of the metric
+// timelines with a metric of the same type holding a single value returned
+// by fn for the samples, newest first, e.g. to report the peak of a gauge
+// timeline:
+//
+//	TotalFunc(g, func(samples []Metric) float64 {
+//		peak := 0.0
+//		for _, s := range samples {
+//			var gj GaugeJSON
+//			b, _ := json.Marshal(s)
+//			json.Unmarshal(b, &gj)
+//			peak = math.Max(peak, gj.Max)
+//		}
+//		return peak
+//	})
+//
+// The function is called with the timeline locked, so it must not use the
+// metric itself. Other methods like Quantile still use the natural total.
+// Passing nil restores the natural total. Metrics without frames are left as
+// is.
+func TotalFunc(m Metric, fn func(samples []Metric) float64) {
+	switch m := m.(type) {
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		m.totalFn = fn
+	case multimetric:
+		for _, ts := range m {
+			TotalFunc(ts, fn)
+		}
+	}
+}
+
+// OnRoll registers a function that is called each time a timeline of the
+// metric advances, with the number of samples rolled and the current time.
+// Unusually large rolls may indicate clock jumps. The function is called with
+// the timeline locked, so it must not use the metric itself. Passing nil
+// removes the hook. Metrics without frames are left as is.
+func OnRoll(m Metric, fn func(rolled int, now time.Time)) {
+	switch m := m.(type) {
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		m.onRoll = fn
+	case multimetric:
+		for _, ts := range m {
+			OnRoll(ts, fn)
+		}
+	}
+}
+
+// Peek returns the samples of the metric timeline, newest first, without
+// rolling it. Unlike other reads it has no side effects, but the samples may
+// be stale: if no values have been added recently, the newest samples may
+// belong to long-gone intervals. The returned samples are live and are
+// recycled once the timeline rolls. For metrics with several frames the
+// longest timeline is used. Metrics without frames are returned as is.
+func Peek(m Metric) []Metric {
+	switch m := m.(type) {
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		samples := make([]Metric, len(m.samples))
+		for i, s := range m.samples {
+			samples[i] = s
+		}
+		return samples
+	case multimetric:
+		return Peek(m[len(m)-1])
+	}
+	return []Metric{m}
+}
+
+// Integral returns the area under the gauge timeline, i.e. the sum of the
+// sample means multiplied by the sample interval in seconds, e.g. the total
+// number of bytes given a bytes per second gauge. Each sample counts for a
+// whole interval, including the current one. For metrics with several frames
+// the longest timeline is used. It returns 0 for metrics other than gauge
+// timelines.
+func Integral(m Metric) float64 {
+	switch m := m.(type) {
+	case multimetric:
+		return Integral(m[len(m)-1])
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		m.roll()
+		sum := 0.0
+		for _, s := range m.samples {
+			switch s := s.(type) {
+			case *gauge:
+				s.Lock()
+				sum += s.mean()
+				s.Unlock()
+			case *meanGauge:
+				s.Lock()
+				sum += s.mean()
+				s.Unlock()
+			}
+		}
+		return sum * m.interval.Seconds()
+	}
+	return 0
+}
+
+// LastUpdate returns the time when the counter was last incremented, e.g. for
+// liveness checks, or zero time if it has not been incremented since it was
+// created or reset. For counter timelines it is the time of the last
+// increment within the timeline window. Counters without frames don't read
+// the clock on each increment, so they only report it when wrapped with
+// TrackLastUpdate. It returns zero time for metrics other than counters.
+func LastUpdate(m Metric) time.Time {
+	if last := lastUpdateOf(m); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
+// lastUpdateOf returns the LastUpdate time in nanoseconds, or 0.
+func lastUpdateOf(m Metric) (last int64) {
+	walk(m, func(m Metric) bool {
+		switch m := m.(type) {
+		case *lastUpdate:
+			last = atomic.LoadInt64(&m.last)
+		case multimetric:
+			last = lastUpdateOf(m[len(m)-1])
+		case *timeseries:
+			m.Lock()
+			defer m.Unlock()
+			if _, ok := m.total.(*counter); ok {
+				m.roll()
+				_, last = m.window()
+			}
+		default:
+			return false
+		}
+		return true
+	})
+	return last
+}
+
+// TrackLastUpdate returns a metric that remembers the time of each value
+// added to the given metric, see LastUpdate. Timelines keep track of it
+// anyway.
+func TrackLastUpdate(m Metric) Metric {
+	return &lastUpdate{Metric: m}
+}
+
+type lastUpdate struct {
+	Metric
+	// last is the time of the last added value in nanoseconds
+	last int64
+}
+
+func (l *lastUpdate) unwrap() Metric { return l.Metric }
+
+func (l *lastUpdate) Add(n float64) {
+	l.Metric.Add(n)
+	atomic.StoreInt64(&l.last, now().UnixNano())
+}
+
+func (l *lastUpdate) Reset() {
+	resetMetric(l.Metric)
+	atomic.StoreInt64(&l.last, 0)
+}
+
+func (l *lastUpdate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Metric)
+}
+
+// WeightedQuantile returns the quantile of all samples of the histogram
+// timeline, with the counts of each sample weighted by decay^age, where age
+// is 0 for the current sample, 1 for the previous one and so on. A decay of 1
+// gives the quantile of the whole window, smaller values favour recent
+// samples. For metrics with several frames the longest timeline is used. It
+// returns 0 for metrics other than histogram timelines.
+func WeightedQuantile(m Metric, q, decay float64) float64 {
+	switch m := m.(type) {
+	case multimetric:
+		return WeightedQuantile(m[len(m)-1], q, decay)
+	case *timeseries:
+		m.Lock()
+		defer m.Unlock()
+		m.roll()
+		merged := &histogram{}
+		weight := 1.0
+		for _, s := range m.samples {
+			s, ok := s.(*histogram)
+			if !ok {
+				return 0
+			}
+			s.Lock()
+			merged.opts = s.opts
+			for _, b := range s.bins {
+				merged.bins = append(merged.bins, Bin{Value: b.Value, Count: b.Count * weight})
+				merged.total = merged.total + b.Count*weight
+			}
+			s.Unlock()
+			weight = weight * decay
+		}
+		merged.opts.Exact = 0
+		sort.SliceStable(merged.bins, func(i, j int) bool { return merged.bins[i].Value < merged.bins[j].Value })
+		merged.trim()
+		return merged.quantile(q)
+	}
+	return 0
+}
+
+// TrendOptions configures Trend. Zero fields take the defaults.
+type TrendOptions struct {
+	// Quantile of each sample to compare, 0.99 by default.
+	Quantile float64
+	// Baseline combines the quantiles of the previous samples, newest first,
+	// into the baseline. The median is used by default.
+	Baseline func(quantiles []float64) float64
+	// Compare returns the severity of the current quantile given the
+	// baseline. The ratio current/baseline is used by default.
+	Compare func(current, baseline float64) float64
+	// Limit is the severity above which Trend reports an alert, 2 by default.
+	Limit float64
+}
+
+// Trend compares the quantile of the current sample of the histogram timeline
+// against a baseline computed from the quantiles of the previous samples in
+// the window, e.g. to alert when the current p99 latency exceeds twice the
+// median p99 of the window:
+//
+//	if severity, alert := Trend(latency, TrendOptions{}); alert {
+//		log.Printf("latency is %.1f times higher than usual", severity)
+//	}
+//
+// Empty samples are left out. It returns 0 and false if the current sample or
+// all previous samples are empty. For metrics with several frames the longest
+// timeline is used. Metrics other than histogram timelines never alert.
+func Trend(m Metric, opts TrendOptions) (severity float64, alert bool) {
+	if opts.Quantile == 0 {
+		opts.Quantile = 0.99
+	}
+	if opts.Baseline == nil {
+		opts.Baseline = median
+	}
+	if opts.Compare == nil {
+		opts.Compare = func(current, baseline float64) float64 {
+			if baseline == 0 {
+				return 0
+			}
+			return current / baseline
+		}
+	}
+	if opts.Limit == 0 {
+		opts.Limit = 2
+	}
+	switch m := m.(type) {
+	case multimetric:
+		return Trend(m[len(m)-1], opts)
+	case *timeseries:
+		m.Lock()
+		m.roll()
+		var quantiles []float64
+		for _, s := range m.samples {
+			if h, ok := s.(Histogram); ok && !isEmpty(s) {
+				quantiles = append(quantiles, h.Quantile(opts.Quantile))
+			} else if len(quantiles) == 0 {
+				break
+			}
+		}
+		m.Unlock()
+		if len(quantiles) < 2 {
+			return 0, false
+		}
+		severity = opts.Compare(quantiles[0], opts.Baseline(quantiles[1:]))
+		return severity, severity > opts.Limit
+	}
+	return 0, false
+}
+
+// isEmpty returns true if the histogram has no observations.
+func isEmpty(m metric) bool {
+	s, ok := m.(snapshotter)
+	if !ok {
+		return true
+	}
+	for _, b := range s.snapshot() {
+		if b.Count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// median returns the median of the values.
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Merge adds all observations of the src histogram to the dst histogram, e.g.
+// to combine the histograms of several workers. For timelines the total of
+// the longest timeline is merged into the current sample.
+//
+// Merge never holds the locks of both histograms at once: it takes a snapshot
+// of src first and then applies it to dst, so concurrent merges in opposite
+// directions can't deadlock. Operations on several metrics must follow the
+// same rule; the only nested locks are those of a timeline and its own
+// samples, which are always acquired in that order.
+func Merge(dst, src Histogram) {
+	if s, ok := src.(snapshotter); ok {
+		dst.AddPairs(s.snapshot())
+	}
+}
+
+// snapshotter is implemented by histograms that can return a copy of their
+// bins with values in the original scale.
+type snapshotter interface {
+	snapshot() []Bin
+}
+
+func (h *histogram) snapshot() []Bin {
+	h.Lock()
+	defer h.Unlock()
+	bins := make([]Bin, len(h.bins))
+	for i, b := range h.bins {
+		bins[i] = Bin{Value: h.unscale(b.Value), Count: b.Count}
+	}
+	return bins
+}
+
+func (ts *timeseries) snapshot() []Bin {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll()
+	if s, ok := ts.total.(snapshotter); ok {
+		return s.snapshot()
+	}
+	return nil
+}
+
+func (mm multimetric) snapshot() []Bin {
+	return mm[len(mm)-1].snapshot()
+}
+
+// merger is implemented by metrics that can merge several samples into one,
+// when Aggregate does something else.
+type merger interface {
+	merge(samples []metric)
+}
+
+// Resample changes the sample interval of the metric timeline, keeping the
+// recorded history: existing samples are merged into the coarser samples they
+// fall into, e.g. five 1s samples into a single 5s one. The new interval must
+// be a multiple of the current one and the total duration is kept as close as
+// possible. It returns an error for metrics with several frames or without
+// frames, and for metrics that can't be merged, like P² quantiles.
+func Resample(m Metric, interval time.Duration) error {
+	ts, ok := m.(*timeseries)
+	if !ok {
+		return errors.New("metric: only metrics with a single frame can be resampled")
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	if interval < ts.interval || interval%ts.interval != 0 {
+		return fmt.Errorf("metric: %v is not a multiple of %v", interval, ts.interval)
+	}
+	if _, ok := ts.total.(*psquare); ok {
+		return errors.New("metric: P² quantiles can't be resampled")
+	}
+	ts.roll()
+	n := int(ts.span() / interval)
+	if n < 1 {
+		n = 1
+	}
+	groups := make([][]metric, n)
+	stamps := make([]stamp, n)
+	for i, s := range ts.samples {
+		mid := ts.bucket(ts.now).Add(ts.interval/2 - time.Duration(i)*ts.interval)
+		j := int(ts.now.Round(interval).Sub(mid.Round(interval)) / interval)
+		if j < n {
+			groups[j] = append(groups[j], s)
+			if st := ts.stamps[i]; st.first != 0 {
+				stamps[j].mark(st.first)
+				stamps[j].mark(st.last)
+			}
+		}
+	}
+	samples := make([]metric, n)
+	for i, group := range groups {
+		samples[i] = ts.builder()
+		if m, ok := samples[i].(merger); ok {
+			m.merge(group)
+		} else {
+			samples[i].Aggregate(0, group)
+		}
+	}
+	ts.interval, ts.samples, ts.stamps = interval, samples, stamps
+	return nil
+}
+
+// AutoReset returns a metric that resets the given metric each time the
+// period boundary is crossed, e.g. AutoReset(NewCounter(), time.Hour) counts
+// events per hour. The check is done lazily on each Add and each read, so no
+// background goroutine is required.
+func AutoReset(m Metric, period time.Duration) Metric {
+	return &autoReset{Metric: m, period: period, last: now()}
+}
+
+type autoReset struct {
+	sync.Mutex
+	Metric
+	period time.Duration
+	last   time.Time
+}
+
+func (a *autoReset) unwrap() Metric { return a.Metric }
+
+func (a *autoReset) check() {
+	a.Lock()
+	defer a.Unlock()
+	t := now()
+	if t.Truncate(a.period).Equal(a.last.Truncate(a.period)) {
+		return
+	}
+	a.last = t
+	if r, ok := a.Metric.(interface{ Reset() }); ok {
+		r.Reset()
+	}
+}
+
+func (a *autoReset) Add(n float64) {
+	a.check()
+	a.Metric.Add(n)
+}
+
+func (a *autoReset) String() string {
+	a.check()
+	return a.Metric.String()
+}
+
+func (a *autoReset) MarshalJSON() ([]byte, error) {
+	a.check()
+	return json.Marshal(a.Metric)
+}
+
+// Scaled returns a metric that multiplies each incoming value by the factor
+// before adding it to the given metric, e.g. Scaled(NewGauge(), 1e-6) to
+// report megabytes when recording bytes.
+func Scaled(m Metric, factor float64) Metric {
+	return scaled{m, factor}
+}
+
+type scaled struct {
+	Metric
+	factor float64
+}
+
+func (s scaled) unwrap() Metric { return s.Metric }
+
+func (s scaled) Add(n float64) {
+	s.Metric.Add(n * s.factor)
+}
+
+func (s scaled) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Metric)
+}
+
+// OmitEmpty returns a metric that leaves out zero-valued fields from the JSON
+// output of the given metric, which keeps sparse timelines compact. The
+// metric type is always kept, so an empty counter sample becomes
+// {"type":"c"}.
+func OmitEmpty(m Metric) Metric {
+	return omitEmpty{m}
+}
+
+type omitEmpty struct {
+	Metric
+}
+
+func (o omitEmpty) unwrap() Metric { return o.Metric }
+
+func (o omitEmpty) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(o.Metric)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(omitZero(v))
+}
+
+func omitZero(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if isZero(x) {
+				delete(v, k)
+			} else {
+				v[k] = omitZero(x)
+			}
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = omitZero(x)
+		}
+	}
+	return v
+}
+
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case nil:
+		return true
+	}
+	return false
+}
+
+// RenameKeys returns a metric that renames the JSON fields of the given metric,
+// including timeline samples, e.g. to match the names a dashboard expects:
+//
+//	RenameKeys(NewHistogram("15m10s"), map[string]string{"p50": "50th", "p90": "90th"})
+//
+// Fields missing from names keep their original names.
+func RenameKeys(m Metric, names map[string]string) Metric {
+	return renamed{m, names}
+}
+
+type renamed struct {
+	Metric
+	names map[string]string
+}
+
+func (r renamed) unwrap() Metric { return r.Metric }
+
+func (r renamed) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(r.Metric)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r.rename(v))
+}
+
+func (r renamed) rename(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			if name, ok := r.names[k]; ok {
+				k = name
+			}
+			renamed[k] = r.rename(x)
+		}
+		return renamed
+	case []interface{}:
+		for i, x := range v {
+			v[i] = r.rename(x)
+		}
+	}
+	return v
+}
+
+// RateUnit returns a metric that reports the rates of the given derivative,
+// rate counter or acceleration metric per the given unit of time instead of
+// per second, e.g. RateUnit(NewRateCounter("1h1m"), time.Minute) for events
+// per minute. The JSON output includes the unit, {"unit":"per_minute"}, and
+// the acceleration is scaled by the square of the unit. Only the JSON output
+// is scaled, the values are recorded as is.
+func RateUnit(m Metric, unit time.Duration) Metric {
+	return rateUnit{m, unit}
 }
 
-func (ts *timeseries) Reset() {
-	ts.total.Reset()
-	for _, s := range ts.samples {
-		s.Reset()
+type rateUnit struct {
+	Metric
+	unit time.Duration
+}
+
+func (r rateUnit) unwrap() Metric { return r.Metric }
+
+// name returns the name of the unit for the JSON output.
+func (r rateUnit) name() string {
+	switch r.unit {
+	case time.Millisecond:
+		return "per_millisecond"
+	case time.Second:
+		return "per_second"
+	case time.Minute:
+		return "per_minute"
+	case time.Hour:
+		return "per_hour"
 	}
+	return "per_" + r.unit.String()
 }
 
-func (ts *timeseries) roll() {
-	t := now()
-	roll := int((t.Round(ts.interval).Sub(ts.now.Round(ts.interval))) / ts.interval)
-	ts.now = t
-	n := len(ts.samples)
-	if roll <= 0 {
-		return
+func (r rateUnit) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(r.Metric)
+	if err != nil {
+		return nil, err
 	}
-	if roll >= len(ts.samples) {
-		ts.Reset()
-	} else {
-		for i := 0; i < roll; i++ {
-			tmp := ts.samples[n-1]
-			for j := n - 1; j > 0; j-- {
-				ts.samples[j] = ts.samples[j-1]
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return marshal(r.scale(v))
+}
+
+func (r rateUnit) scale(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch v["type"] {
+		case "deriv", "rc", "accel":
+			f := r.unit.Seconds()
+			for k, factor := range map[string]float64{"rate": f, "accel": f * f} {
+				if n, ok := v[k].(json.Number); ok {
+					x, _ := n.Float64()
+					v[k] = x * factor
+				}
 			}
-			ts.samples[0] = tmp
-			ts.samples[0].Reset()
+			v["unit"] = r.name()
+			return v
+		}
+		for k, x := range v {
+			v[k] = r.scale(x)
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = r.scale(x)
 		}
-		ts.total.Aggregate(roll, ts.samples)
 	}
+	return v
 }
 
-func (ts *timeseries) Add(n float64) {
-	ts.Lock()
-	defer ts.Unlock()
-	ts.roll()
-	ts.total.Add(n)
-	ts.samples[0].Add(n)
+// Freeze returns an immutable copy of the metric state: its JSON and String
+// are recorded at the time of the call, and Add does nothing. Timelines are
+// rolled once, when frozen. If a metric of this package changes between the
+// two reads, they are repeated (up to maxFreezeReads times), so that JSON and
+// String describe the same state.
+func Freeze(m Metric) Metric {
+	for i := 1; ; i++ {
+		v, versioned := versionOf(m)
+		b, err := json.Marshal(m)
+		s := m.String()
+		if after, _ := versionOf(m); !versioned || after == v || i == maxFreezeReads {
+			return frozen{b, s, err}
+		}
+	}
 }
 
-func (ts *timeseries) MarshalJSON() ([]byte, error) {
-	ts.Lock()
-	defer ts.Unlock()
-	ts.roll()
-	return json.Marshal(struct {
-		Interval float64  `json:"interval"`
-		Total    Metric   `json:"total"`
-		Samples  []metric `json:"samples"`
-	}{float64(ts.interval) / float64(time.Second), ts.total, ts.samples})
+// maxFreezeReads limits the reads of a metric that keeps changing while it's
+// frozen.
+const maxFreezeReads = 100
+
+type frozen struct {
+	json []byte
+	str  string
+	err  error
 }
 
-func (ts *timeseries) String() string {
-	ts.Lock()
-	defer ts.Unlock()
-	ts.roll()
-	return ts.total.String()
+func (f frozen) Add(n float64)                {}
+func (f frozen) String() string               { return f.str }
+func (f frozen) MarshalJSON() ([]byte, error) { return f.json, f.err }
+
+// Pausable is a metric that can temporarily ignore the observations.
+type Pausable interface {
+	Metric
+	Pause()
+	Resume()
+	Paused() bool
 }
 
-type multimetric []*timeseries
+// NewPausable returns a metric that forwards all observations to the given
+// metric unless paused, e.g. to keep maintenance windows from skewing the
+// percentiles. While paused Add is a no-op, but the metric is still marshaled
+// with its last state. Pause and Resume are safe for concurrent use.
+func NewPausable(m Metric) Pausable {
+	return &pausable{Metric: m}
+}
 
-func (mm multimetric) Add(n float64) {
-	for _, m := range mm {
-		m.Add(n)
-	}
+type pausable struct {
+	Metric
+	paused uint32
 }
 
-func (mm multimetric) MarshalJSON() ([]byte, error) {
-	b := []byte(`{"metrics":[`)
-	for i, m := range mm {
-		if i != 0 {
-			b = append(b, ',')
-		}
-		x, _ := json.Marshal(m)
-		b = append(b, x...)
+func (p *pausable) unwrap() Metric { return p.Metric }
+
+func (p *pausable) Pause()       { atomic.StoreUint32(&p.paused, 1) }
+func (p *pausable) Resume()      { atomic.StoreUint32(&p.paused, 0) }
+func (p *pausable) Paused() bool { return atomic.LoadUint32(&p.paused) != 0 }
+
+func (p *pausable) Add(n float64) {
+	if !p.Paused() {
+		p.Metric.Add(n)
 	}
-	b = append(b, ']', '}')
-	return b, nil
 }
 
-func (mm multimetric) String() string {
-	return mm[len(mm)-1].String()
+func (p *pausable) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Metric)
 }
 
 type counter struct {
+	meta
 	count uint64
+	// overflow is set once an increment is lost, because the count is too
+	// large to be changed by it (2^53 and above for integer increments)
+	overflow uint32
 }
 
 func (c *counter) String() string { return strconv.FormatFloat(c.value(), 'g', -1, 64) }
-func (c *counter) Reset()         { atomic.StoreUint64(&c.count, math.Float64bits(0)) }
+func (c *counter) Reset() {
+	c.reset()
+	atomic.StoreUint64(&c.count, math.Float64bits(0))
+	atomic.StoreUint32(&c.overflow, 0)
+}
 func (c *counter) value() float64 { return math.Float64frombits(atomic.LoadUint64(&c.count)) }
 func (c *counter) Add(n float64) {
 	for {
 		old := math.Float64frombits(atomic.LoadUint64(&c.count))
 		new := old + n
 		if atomic.CompareAndSwapUint64(&c.count, math.Float64bits(old), math.Float64bits(new)) {
+			// Tiny fractions are lost at any magnitude, only lost increments of
+			// counts beyond exact integers are reported
+			if (new == old && n != 0 && math.Abs(old) >= 1<<53) || (math.IsInf(new, 0) && !math.IsInf(old, 0)) {
+				atomic.StoreUint32(&c.overflow, 1)
+			}
+			c.touch()
 			return
 		}
 	}
 }
 func (c *counter) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Type  string  `json:"type"`
-		Count float64 `json:"count"`
-	}{"c", c.value()})
+	return marshal(CounterJSON{"c", c.value(), atomic.LoadUint32(&c.overflow) != 0, c.meta.meta()})
 }
 
 func (c *counter) Aggregate(roll int, samples []metric) {
 	c.Reset()
 	for _, s := range samples {
-		c.Add(s.(*counter).value())
+		s := s.(*counter)
+		c.Add(s.value())
+		if atomic.LoadUint32(&s.overflow) != 0 {
+			atomic.StoreUint32(&c.overflow, 1)
+		}
 	}
 }
 
 type gauge struct {
 	sync.Mutex
+	meta
+	opts  GaugeOptions
 	value float64
 	sum   float64
 	min   float64
 	max   float64
 	count int
+	up    int
+	down  int
+	// seeded is set when min and max are carried over by ResetSoft
+	seeded bool
 }
 
 func (g *gauge) String() string { return strconv.FormatFloat(g.value, 'g', -1, 64) }
+
+// Reset clears the gauge completely, so the first value added afterwards
+// becomes the new min and max.
 func (g *gauge) Reset() {
 	g.Lock()
 	defer g.Unlock()
+	g.reset()
 	g.value, g.count, g.sum, g.min, g.max = 0, 0, 0, 0, 0
+	g.up, g.down = 0, 0
+	g.seeded = false
+	g.init()
 }
+
+// init sets the initial value of an empty gauge, if configured.
+func (g *gauge) init() {
+	if v := g.opts.Initial; v != nil {
+		g.value, g.min, g.max = *v, *v, *v
+	}
+}
+
+// ResetSoft starts a new window for the mean, but keeps the last value as the
+// initial min and max, as if it was still observed. This suits continuous
+// gauges, e.g. a queue length sampled after the reset, where the level at the
+// reset time belongs to the new window as well.
+func (g *gauge) ResetSoft() {
+	g.Lock()
+	defer g.Unlock()
+	g.reset()
+	g.count, g.sum, g.up, g.down = 0, 0, 0, 0
+	g.min, g.max = g.value, g.value
+	g.seeded = true
+}
+
 func (g *gauge) Add(n float64) {
 	g.Lock()
 	defer g.Unlock()
-	if n < g.min || g.count == 0 {
+	fresh := g.count == 0 && !g.seeded
+	if n < g.min || fresh {
 		g.min = n
 	}
-	if n > g.max || g.count == 0 {
+	if n > g.max || fresh {
 		g.max = n
 	}
+	if !fresh && n > g.value {
+		g.up++
+	} else if !fresh && n < g.value {
+		g.down++
+	}
 	g.value = n
-	g.sum += n
+	g.sum += g.opts.Aggregation.mapValue(n)
 	g.count++
+	g.touch()
 }
 func (g *gauge) MarshalJSON() ([]byte, error) {
 	g.Lock()
 	defer g.Unlock()
-	return json.Marshal(struct {
-		Type  string  `json:"type"`
-		Value float64 `json:"value"`
-		Mean  float64 `json:"mean"`
-		Min   float64 `json:"min"`
-		Max   float64 `json:"max"`
-	}{"g", g.value, g.mean(), g.min, g.max})
+	gj := GaugeJSON{Type: "g", Value: g.value, Mean: g.mean(), Min: g.min, Max: g.max, Meta: g.meta.meta()}
+	if g.opts.Churn {
+		up, down := g.up, g.down
+		gj.Up, gj.Down = &up, &down
+	}
+	if g.opts.Threshold != nil {
+		gj.Status = g.opts.Threshold.status(g.value)
+	}
+	return marshal(gj)
 }
 func (g *gauge) mean() float64 {
-	if g.count == 0 {
+	if g.count == 0 && g.opts.Initial != nil && !g.seeded {
+		return *g.opts.Initial
+	} else if g.count == 0 {
 		return 0
 	}
-	return g.sum / float64(g.count)
+	return g.opts.Aggregation.inverse(g.sum / float64(g.count))
 }
 func (g *gauge) Aggregate(roll int, samples []metric) {
 	g.Reset()
@@ -232,138 +1786,584 @@ func (g *gauge) Aggregate(roll int, samples []metric) {
 		}
 		g.count += s.count
 		g.sum += s.sum
+		g.up += s.up
+		g.down += s.down
 		g.value = s.value
 		s.Unlock()
 	}
 }
 
+type meanGauge struct {
+	sync.Mutex
+	meta
+	sum   float64
+	count int
+}
+
+func (g *meanGauge) String() string {
+	g.Lock()
+	defer g.Unlock()
+	return strconv.FormatFloat(g.mean(), 'g', -1, 64)
+}
+func (g *meanGauge) Reset() {
+	g.Lock()
+	defer g.Unlock()
+	g.reset()
+	g.sum, g.count = 0, 0
+}
+func (g *meanGauge) Add(n float64) {
+	g.Lock()
+	defer g.Unlock()
+	g.sum += n
+	g.count++
+	g.touch()
+}
+func (g *meanGauge) MarshalJSON() ([]byte, error) {
+	g.Lock()
+	defer g.Unlock()
+	return marshal(struct {
+		Type string    `json:"type"`
+		Mean float64   `json:"mean"`
+		Meta *MetaJSON `json:"_meta,omitempty"`
+	}{"g", g.mean(), g.meta.meta()})
+}
+func (g *meanGauge) mean() float64 {
+	if g.count == 0 {
+		return 0
+	}
+	return g.sum / float64(g.count)
+}
+func (g *meanGauge) Aggregate(roll int, samples []metric) {
+	g.Lock()
+	defer g.Unlock()
+	g.touch()
+	g.sum, g.count = 0, 0
+	for _, s := range samples {
+		s := s.(*meanGauge)
+		s.Lock()
+		g.sum += s.sum
+		g.count += s.count
+		s.Unlock()
+	}
+}
+
+type derivative struct {
+	sync.Mutex
+	meta
+	last  float64
+	at    time.Time
+	rate  float64
+	count int
+}
+
+func (d *derivative) String() string {
+	d.Lock()
+	defer d.Unlock()
+	return strconv.FormatFloat(d.rate, 'g', -1, 64)
+}
+
+func (d *derivative) carry(prev metric) {
+	p := prev.(*derivative)
+	p.Lock()
+	last, at := p.last, p.at
+	p.Unlock()
+	d.Lock()
+	defer d.Unlock()
+	d.last, d.at = last, at
+}
+
+// Reset clears the rate, but keeps the last absolute value so that the rate
+// is known as soon as the next value arrives.
+func (d *derivative) Reset() {
+	d.Lock()
+	defer d.Unlock()
+	d.reset()
+	d.rate, d.count = 0, 0
+}
+
+func (d *derivative) Add(n float64) {
+	d.Lock()
+	defer d.Unlock()
+	t := now()
+	if !d.at.IsZero() {
+		if dt := t.Sub(d.at).Seconds(); dt > 0 {
+			d.rate = (n - d.last) / dt
+		}
+	}
+	d.last, d.at = n, t
+	d.count++
+	d.touch()
+}
+
+func (d *derivative) MarshalJSON() ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	return marshal(struct {
+		Type string    `json:"type"`
+		Rate float64   `json:"rate"`
+		Meta *MetaJSON `json:"_meta,omitempty"`
+	}{"deriv", d.rate, d.meta.meta()})
+}
+
+// Aggregate reports the most recent known rate within the samples.
+func (d *derivative) Aggregate(roll int, samples []metric) {
+	d.Lock()
+	defer d.Unlock()
+	d.touch()
+	d.rate = 0
+	for _, s := range samples {
+		s := s.(*derivative)
+		s.Lock()
+		count, rate := s.count, s.rate
+		s.Unlock()
+		if count > 0 {
+			d.rate = rate
+			break
+		}
+	}
+}
+
 const maxBins = 100
 
-type bin struct {
-	value float64
-	count float64
+// Bin is a histogram bin: an approximate value and the number of
+// observations merged into it.
+type Bin struct {
+	Value float64
+	Count float64
 }
 
 type histogram struct {
 	sync.Mutex
-	bins  []bin
-	total float64
+	meta
+	opts     HistogramOptions
+	bins     []Bin
+	total    float64
+	duration bool
+	// merged is set once the bins exceeded Exact and were merged
+	merged bool
 }
 
+// String returns the same JSON as MarshalJSON, so the two never diverge.
 func (h *histogram) String() string {
-	return fmt.Sprintf(`{"p50":%g,"p90":%g,"p99":%g}`, h.quantile(0.5), h.quantile(0.9), h.quantile(0.99))
+	b, _ := h.MarshalJSON()
+	return string(b)
 }
 
 func (h *histogram) Reset() {
 	h.Lock()
 	defer h.Unlock()
-	h.bins = nil
+	h.reset()
 	h.total = 0
+	h.merged = false
+	if h.opts.KeepBins {
+		for i := range h.bins {
+			h.bins[i].Count = 0
+		}
+		return
+	}
+	// Keep the capacity, timeline samples are reset on each roll
+	h.bins = h.bins[:0]
 }
 
 func (h *histogram) Add(n float64) {
+	h.AddWeighted(n, 1)
+}
+
+// scale maps a value to the scale the bins are kept in, or returns false if
+// the value can't be represented in it.
+func (h *histogram) scale(x float64) (float64, bool) {
+	if !h.opts.LogScale {
+		return x, true
+	}
+	return math.Log(x), x > 0
+}
+
+// unscale maps a bin value back to the original scale.
+func (h *histogram) unscale(x float64) float64 {
+	if !h.opts.LogScale {
+		return x
+	}
+	return math.Exp(x)
+}
+
+// AddWeighted adds a value that has been observed weight times. Zero,
+// negative and NaN weights are ignored.
+func (h *histogram) AddWeighted(n, weight float64) {
+	n, ok := h.scale(n)
+	if !(weight > 0) || !ok {
+		return
+	}
 	h.Lock()
 	defer h.Unlock()
 	defer h.trim()
-	h.total = h.total + 1
-	newbin := bin{value: n, count: 1}
-	for i := range h.bins {
-		if h.bins[i].value > n {
-			h.bins = append(h.bins[:i], append([]bin{newbin}, h.bins[i:]...)...)
-			return
+	h.touch()
+	h.total = h.total + weight
+	i := sort.Search(len(h.bins), func(i int) bool { return h.bins[i].Value >= n })
+	if i < len(h.bins) && h.bins[i].Value == n {
+		// Discrete values share a bin instead of being merged later
+		h.bins[i].Count += weight
+		return
+	}
+	if h.opts.KeepBins && len(h.bins) >= maxBins {
+		if i == len(h.bins) || (i > 0 && n-h.bins[i-1].Value < h.bins[i].Value-n) {
+			i--
+		}
+		h.bins[i].Count += weight
+		return
+	}
+	h.bins = append(h.bins, Bin{})
+	copy(h.bins[i+1:], h.bins[i:])
+	h.bins[i] = Bin{Value: n, Count: weight}
+}
+
+// AddPairs adds a batch of weighted observations, e.g. when importing
+// pre-aggregated data. It is faster than calling AddWeighted for each pair,
+// because bins are only sorted and merged once. Pairs with non-positive
+// counts are ignored.
+func (h *histogram) AddPairs(pairs []Bin) {
+	h.Lock()
+	defer h.Unlock()
+	h.touch()
+	for _, p := range pairs {
+		if v, ok := h.scale(p.Value); ok && p.Count > 0 {
+			h.bins = append(h.bins, Bin{Value: v, Count: p.Count})
+			h.total = h.total + p.Count
+			h.compact(false)
 		}
 	}
+	h.compact(true)
+}
 
-	h.bins = append(h.bins, newbin)
+// compact sorts and trims the bins appended in bulk. Unless forced, it only
+// does so once there are twice as many bins as allowed, which keeps the
+// memory bounded while loading large batches.
+func (h *histogram) compact(force bool) {
+	if !force && (len(h.bins) < 2*maxBins || h.exact()) {
+		return
+	}
+	sort.SliceStable(h.bins, func(i, j int) bool { return h.bins[i].Value < h.bins[j].Value })
+	h.trim()
 }
 
 func (h *histogram) MarshalJSON() ([]byte, error) {
 	h.Lock()
 	defer h.Unlock()
-	return json.Marshal(struct {
-		Type string  `json:"type"`
-		P50  float64 `json:"p50"`
-		P90  float64 `json:"p90"`
-		P99  float64 `json:"p99"`
-	}{"h", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)})
+	p50, p90, p99 := h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)
+	var p50s, p90s, p99s string
+	if h.duration {
+		p50s, p90s, p99s = seconds(p50), seconds(p90), seconds(p99)
+	}
+	return marshal(HistogramJSON{"h", p50, p90, p99, h.min(), h.max(), h.mean(), p50s, p90s, p99s,
+		h.width(0.5), h.width(0.9), h.width(0.99), h.meta.meta()})
+}
+
+func (h *histogram) mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, b := range h.bins {
+		sum = sum + h.unscale(b.Value)*b.Count
+	}
+	return sum / h.total
+}
+
+// seconds formats a number of seconds as a duration string, rounded to keep
+// roughly three significant digits.
+func seconds(n float64) string {
+	d := time.Duration(n * float64(time.Second))
+	for _, unit := range []time.Duration{time.Second, time.Millisecond, time.Microsecond} {
+		if d >= unit || d <= -unit {
+			return d.Round(unit / 100).String()
+		}
+	}
+	return d.String()
+}
+
+// min and max skip the bins emptied by Reset with KeepBins.
+func (h *histogram) min() float64 {
+	for _, b := range h.bins {
+		if b.Count > 0 {
+			return h.unscale(b.Value)
+		}
+	}
+	return 0
+}
+
+func (h *histogram) max() float64 {
+	for i := len(h.bins) - 1; i >= 0; i-- {
+		if h.bins[i].Count > 0 {
+			return h.unscale(h.bins[i].Value)
+		}
+	}
+	return 0
+}
+
+// exact returns true if the bins are still kept exact, see Exact. It
+// depends on the number of bins rather than on the total, which decays in
+// timeline totals.
+func (h *histogram) exact() bool {
+	return h.opts.Exact > 0 && !h.merged && len(h.bins) <= h.opts.Exact
 }
 
 func (h *histogram) trim() {
+	if h.exact() {
+		return
+	}
+	if h.opts.Exact > 0 && len(h.bins) > maxBins {
+		h.merged = true
+	}
 	for len(h.bins) > maxBins {
 		d := float64(0)
 		i := 0
 		for j := 1; j < len(h.bins); j++ {
-			if dv := h.bins[j].value - h.bins[j-1].value; dv < d || j == 1 {
+			if dv := h.bins[j].Value - h.bins[j-1].Value; dv < d || j == 1 {
 				d = dv
 				i = j
 			}
 		}
-		count := h.bins[i-1].count + h.bins[i].count
-		merged := bin{
-			value: (h.bins[i-1].value*h.bins[i-1].count + h.bins[i].value*h.bins[i].count) / count,
-			count: count,
+		count := h.bins[i-1].Count + h.bins[i].Count
+		merged := Bin{Value: (h.bins[i-1].Value + h.bins[i].Value) / 2, Count: count}
+		if count > 0 {
+			merged.Value = (h.bins[i-1].Value*h.bins[i-1].Count + h.bins[i].Value*h.bins[i].Count) / count
 		}
 		h.bins = append(h.bins[:i-1], h.bins[i:]...)
 		h.bins[i-1] = merged
 	}
 }
 
-func (h *histogram) bin(q float64) bin {
+// index returns the index of the bin containing the quantile, or -1 if the
+// histogram is empty.
+func (h *histogram) index(q float64) int {
 	count := q * h.total
 	for i := range h.bins {
-		count -= float64(h.bins[i].count)
-		if count <= 0 {
-			return h.bins[i]
+		count -= float64(h.bins[i].Count)
+		if count <= 0 && h.bins[i].Count > 0 {
+			return i
 		}
 	}
-	return bin{}
+	return -1
+}
+
+// width returns the width of the bin containing the quantile, which spans
+// from the midpoint with the previous bin to the midpoint with the next one,
+// or 0 while the histogram is exact, since bins are then the observed values.
+func (h *histogram) width(q float64) float64 {
+	i := h.index(q)
+	if i < 0 || h.exact() {
+		return 0
+	}
+	lo, hi := h.bins[i].Value, h.bins[i].Value
+	if i > 0 {
+		lo = (h.bins[i-1].Value + lo) / 2
+	}
+	if i < len(h.bins)-1 {
+		hi = (hi + h.bins[i+1].Value) / 2
+	}
+	return h.unscale(hi) - h.unscale(lo)
+}
+
+// Quantile returns an approximate value below which the given fraction of
+// observations fall, e.g. Quantile(0.99) is the 99th percentile.
+func (h *histogram) Quantile(q float64) float64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.quantile(q)
 }
 
 func (h *histogram) quantile(q float64) float64 {
-	return h.bin(q).value
+	if q = clampQuantile(q); math.IsNaN(q) {
+		return q
+	}
+	switch h.opts.Method {
+	case QuantileNearestRank:
+		return h.nearestRank(q)
+	case QuantileLinear:
+		return h.linear(q)
+	}
+	if i := h.index(q); i >= 0 {
+		return h.unscale(h.bins[i].Value)
+	}
+	return 0
+}
+
+func (h *histogram) Mode() float64 {
+	return mode(h.snapshot())
+}
+
+// Rank returns the fraction of observations less than or equal to the value,
+// counting whole bins.
+func (h *histogram) Rank(value float64) float64 {
+	h.Lock()
+	defer h.Unlock()
+	x, ok := h.scale(value)
+	if !ok || h.total == 0 {
+		return 0
+	}
+	count := 0.0
+	for _, b := range h.bins {
+		if b.Value > x {
+			break
+		}
+		count = count + b.Count
+	}
+	return count / h.total
+}
+
+func (h *histogram) nearestRank(q float64) float64 {
+	rank := math.Max(1, math.Ceil(q*h.total))
+	count := 0.0
+	for _, b := range h.bins {
+		if count = count + b.Count; count >= rank && b.Count > 0 {
+			return h.unscale(b.Value)
+		}
+	}
+	return h.max()
+}
+
+func (h *histogram) linear(q float64) float64 {
+	pos := q * (h.total - 1)
+	count := 0.0
+	for i, b := range h.bins {
+		if b.Count == 0 {
+			continue
+		}
+		count = count + b.Count
+		if pos <= count-1 {
+			return h.unscale(b.Value)
+		}
+		if pos < count {
+			// The next observation is in the next non-empty bin
+			for _, next := range h.bins[i+1:] {
+				if next.Count > 0 {
+					lo, hi := h.unscale(b.Value), h.unscale(next.Value)
+					return lo + (pos-(count-1))*(hi-lo)
+				}
+			}
+		}
+	}
+	return h.max()
+}
+
+// merge replaces the bins with the bins of all samples.
+func (h *histogram) merge(samples []metric) {
+	h.Lock()
+	defer h.Unlock()
+	h.touch()
+	h.bins, h.total = h.bins[:0], 0
+	for _, s := range samples {
+		s := s.(*histogram)
+		s.Lock()
+		h.bins = append(h.bins, s.bins...)
+		h.total = h.total + s.total
+		s.Unlock()
+		h.compact(false)
+	}
+	h.compact(true)
 }
 
 func (h *histogram) Aggregate(roll int, samples []metric) {
 	h.Lock()
 	defer h.Unlock()
+	h.touch()
 	alpha := 2 / float64(len(samples)+1)
 	h.total = 0
 	for i := range h.bins {
-		h.bins[i].count = h.bins[i].count * math.Pow(1-alpha, float64(roll))
-		h.total = h.total + h.bins[i].count
+		h.bins[i].Count = h.bins[i].Count * math.Pow(1-alpha, float64(roll))
+		h.total = h.total + h.bins[i].Count
+	}
+}
+
+// units maps frame units to durations, see parseFrame.
+var units = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  time.Hour * 24,
+	"w":  time.Hour * 24 * 7,
+	"M":  time.Hour * 24 * 30,
+	"y":  time.Hour * 24 * 365,
+}
+
+// parseFrame parses a frame like "15m10s" or "2s500ms" into the total
+// duration and the sample interval. A frame without an interval, e.g. "15m",
+// uses one minute. Invalid or unknown parts are zero and reported as an error.
+func parseFrame(frame string) (total, interval time.Duration, err error) {
+	var d [2]time.Duration
+	rest := frame
+	for i := range d {
+		if i == 1 && rest == "" && err == nil {
+			d[1] = time.Minute
+			break
+		}
+		j := 0
+		for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+			j++
+		}
+		n, _ := strconv.Atoi(rest[:j])
+		k := j
+		if strings.HasPrefix(rest[j:], "ms") {
+			k = j + 2
+		} else if j < len(rest) {
+			k = j + 1
+		}
+		d[i] = units[rest[j:k]] * time.Duration(n)
+		if d[i] <= 0 && err == nil {
+			err = fmt.Errorf("metric: invalid frame %q", frame)
+		}
+		rest = rest[k:]
+	}
+	if rest != "" && err == nil {
+		err = fmt.Errorf("metric: invalid frame %q", frame)
 	}
+	if d[0] < d[1] && err == nil {
+		err = fmt.Errorf("metric: frame %q is shorter than its interval", frame)
+	} else if d[0] < 2*d[1] && err == nil {
+		err = fmt.Errorf("metric: frame %q keeps less than 2 samples", frame)
+	}
+	return d[0], d[1], err
+}
+
+// ValidateFrames checks that all frames are well-formed, i.e. consist of a
+// total duration followed by an optional sample interval of one minute by
+// default, e.g. "15m10s" or "15m", and that the total duration is at least
+// twice the interval, so that the timeline keeps at least 2 samples.
+// Constructors silently replace invalid frames with defaults, so it's worth
+// validating frames that come from configuration, or using the constructors
+// that return the error, like NewCounterE. The returned error names the first
+// invalid frame.
+func ValidateFrames(frames ...string) error {
+	for _, frame := range frames {
+		if _, _, err := parseFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func newTimeseries(builder func() metric, frame string) *timeseries {
-	var (
-		totalNum, intervalNum   int
-		totalUnit, intervalUnit rune
-	)
-	units := map[rune]time.Duration{
-		's': time.Second,
-		'm': time.Minute,
-		'h': time.Hour,
-		'd': time.Hour * 24,
-		'w': time.Hour * 24 * 7,
-		'M': time.Hour * 24 * 30,
-		'y': time.Hour * 24 * 365,
-	}
-	fmt.Sscanf(frame, "%d%c%d%c", &totalNum, &totalUnit, &intervalNum, &intervalUnit)
-	interval := units[intervalUnit] * time.Duration(intervalNum)
+	totalDuration, interval, _ := parseFrame(frame)
 	if interval == 0 {
 		interval = time.Minute
 	}
-	totalDuration := units[totalUnit] * time.Duration(totalNum)
 	if totalDuration == 0 {
 		totalDuration = interval * 15
 	}
+	// Frames shorter than their interval, e.g. "1s1m", still keep one sample
 	n := int(totalDuration / interval)
+	if n < 2 && Logger != nil {
+		Logger.Printf("frame %q keeps a single sample, the timeline history is lost on each roll", frame)
+	}
+	if n < 1 {
+		n = 1
+	}
 	samples := make([]metric, n, n)
 	for i := 0; i < n; i++ {
 		samples[i] = builder()
 	}
 	totalMetric := builder()
-	return &timeseries{interval: interval, total: totalMetric, samples: samples}
+	return &timeseries{interval: interval, total: totalMetric, samples: samples, builder: builder, start: now(), stamps: make([]stamp, n)}
 }
 
 func newMetric(builder func() metric, frames ...string) Metric {
@@ -378,8 +2378,7 @@ func newMetric(builder func() metric, frames ...string) Metric {
 		mm = append(mm, newTimeseries(builder, frame))
 	}
 	sort.Slice(mm, func(i, j int) bool {
-		a, b := mm[i], mm[j]
-		return a.interval.Seconds()*float64(len(a.samples)) < b.interval.Seconds()*float64(len(b.samples))
+		return mm[i].span() < mm[j].span()
 	})
 	return mm
 }
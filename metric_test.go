@@ -1,13 +1,29 @@
 package metric
 
 import (
+	"context"
 	"encoding/json"
 	"expvar"
+	"io"
+	"log"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 type (
@@ -50,6 +66,59 @@ func TestCounter(t *testing.T) {
 	assertJSON(t, c, h{"type": "c", "count": 11})
 }
 
+func TestLastUpdate(t *testing.T) {
+	now = mockTime(0)
+	c := TrackLastUpdate(NewCounter())
+	if last := LastUpdate(c); !last.IsZero() {
+		t.Fatal(last)
+	}
+	c.Add(1)
+	now = mockTime(5)
+	if last := LastUpdate(c); !last.Equal(mockTime(0)()) {
+		t.Fatal(last)
+	}
+	if s := c.String(); s != "1" {
+		t.Fatal(s)
+	}
+	resetMetric(c)
+	if last := LastUpdate(c); !last.IsZero() {
+		t.Fatal(last)
+	}
+	// Bare counters don't read the clock
+	bare := NewCounter()
+	bare.Add(1)
+	if last := LastUpdate(bare); !last.IsZero() {
+		t.Fatal(last)
+	}
+
+	tl := NewCounter("3s1s", "10s1s")
+	tl.Add(1)
+	now = mockTime(7)
+	if last := LastUpdate(tl); !last.Equal(mockTime(5)()) {
+		t.Fatal(last)
+	}
+	now = mockTime(20)
+	if last := LastUpdate(tl); !last.IsZero() {
+		t.Fatal(last)
+	}
+	if last := LastUpdate(NewGauge()); !last.IsZero() {
+		t.Fatal(last)
+	}
+}
+
+func TestCounterOverflow(t *testing.T) {
+	c := NewCounter()
+	c.Add(1 << 53)
+	assertJSON(t, c, h{"type": "c", "count": 1 << 53})
+	c.Add(1)
+	assertJSON(t, c, h{"type": "c", "count": 1 << 53, "overflow": true})
+	c.(interface{ Reset() }).Reset()
+	assertJSON(t, c, h{"type": "c", "count": 0})
+	c.Add(1e10)
+	c.Add(1e-10)
+	assertJSON(t, c, h{"type": "c", "count": 1e10})
+}
+
 func TestGauge(t *testing.T) {
 	g := NewGauge()
 	assertJSON(t, g, h{"type": "g", "mean": 0, "min": 0, "max": 0, "value": 0})
@@ -61,170 +130,2570 @@ func TestGauge(t *testing.T) {
 	assertJSON(t, g, h{"type": "g", "mean": 2, "min": 0, "max": 5, "value": 0})
 }
 
-func TestHistogram(t *testing.T) {
-	hist := NewHistogram()
-	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0})
-	hist.Add(1)
-	assertJSON(t, hist, h{"type": "h", "p50": 1, "p90": 1, "p99": 1})
-	for i := 2; i < 100; i++ {
-		hist.Add(float64(i))
+func TestGaugeNegative(t *testing.T) {
+	g := NewGauge()
+	for _, v := range []float64{-5, -3, -10} {
+		g.Add(v)
+	}
+	assertJSON(t, g, h{"type": "g", "mean": -6, "min": -10, "max": -3, "value": -10})
+	g.(interface{ Reset() }).Reset()
+	g.Add(-2)
+	assertJSON(t, g, h{"type": "g", "mean": -2, "min": -2, "max": -2, "value": -2})
+
+	// Empty samples in between must not contribute their zero min and max
+	now = mockTime(0)
+	tl := NewGauge("5s1s", "10s5s")
+	tl.Add(-5)
+	now = mockTime(2)
+	tl.Add(-3)
+	now = mockTime(4)
+	tl.Add(-10)
+	for _, ts := range tl.(multimetric) {
+		b, _ := json.Marshal(ts)
+		var tj TimelineJSON
+		var gj GaugeJSON
+		json.Unmarshal(b, &tj)
+		if json.Unmarshal(tj.Total, &gj); gj.Min != -10 || gj.Max != -3 || gj.Mean != -6 {
+			t.Fatal(string(b))
+		}
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	a := NewAvailability()
+	for _, up := range []float64{1, 1, 0, 5} {
+		a.Add(up)
+	}
+	assertJSON(t, a, h{"type": "avail", "uptime": 0.75, "state": 1})
+
+	now = mockTime(0)
+	tl := NewAvailability("3s1s")
+	tl.Add(1)
+	tl.Add(1)
+	now = mockTime(1)
+	tl.Add(0)
+	tl.Add(1)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "avail", "uptime": 0.75, "state": 1}, "samples": v{
+		h{"type": "avail", "uptime": 0.5, "state": 1}, h{"type": "avail", "uptime": 1, "state": 1},
+		h{"type": "avail", "uptime": 0, "state": 0},
+	}})
+}
+
+func TestGaugeResetSoft(t *testing.T) {
+	g := NewGauge()
+	for _, v := range []float64{3, 7, 5} {
+		g.Add(v)
+	}
+	g.(interface{ ResetSoft() }).ResetSoft()
+	assertJSON(t, g, h{"type": "g", "value": 5, "mean": 0, "min": 5, "max": 5})
+	g.Add(6)
+	assertJSON(t, g, h{"type": "g", "value": 6, "mean": 6, "min": 5, "max": 6})
+	g.(interface{ Reset() }).Reset()
+	g.Add(6)
+	assertJSON(t, g, h{"type": "g", "value": 6, "mean": 6, "min": 6, "max": 6})
+}
+
+func TestGaugeAggregation(t *testing.T) {
+	g := NewGaugeWith(GaugeOptions{Aggregation: GeometricMean})
+	g.Add(1)
+	g.Add(100)
+	var gj GaugeJSON
+	b, _ := json.Marshal(g)
+	if json.Unmarshal(b, &gj); math.Abs(gj.Mean-10) > 1e-9 || gj.Min != 1 || gj.Max != 100 {
+		t.Fatal(gj)
+	}
+
+	now = mockTime(0)
+	tl := NewGaugeWith(GaugeOptions{Aggregation: HarmonicMean}, "3s1s")
+	tl.Add(1)
+	now = mockTime(1)
+	tl.Add(4)
+	tl.Add(4)
+	assertJSON(t, tl, h{"interval": 1,
+		"total": h{"type": "g", "mean": 2, "min": 1, "max": 4, "value": 4},
+		"samples": v{
+			h{"type": "g", "mean": 4, "min": 4, "max": 4, "value": 4},
+			h{"type": "g", "mean": 1, "min": 1, "max": 1, "value": 1},
+			h{"type": "g", "mean": 0, "min": 0, "max": 0, "value": 0},
+		}})
+}
+
+func TestGaugeChurn(t *testing.T) {
+	g := NewGaugeWith(GaugeOptions{Churn: true})
+	assertJSON(t, g, h{"type": "g", "value": 0, "mean": 0, "min": 0, "max": 0, "up": 0, "down": 0})
+	for _, v := range []float64{3, 5, 5, 2, 4, 1} {
+		g.Add(v)
+	}
+	assertJSON(t, g, h{"type": "g", "value": 1, "mean": 10.0 / 3, "min": 1, "max": 5, "up": 2, "down": 2})
+}
+
+func TestGaugeInitial(t *testing.T) {
+	initial := 20.0
+	g := NewGaugeWith(GaugeOptions{Initial: &initial})
+	assertJSON(t, g, h{"type": "g", "value": 20, "mean": 20, "min": 20, "max": 20})
+	g.Add(25)
+	g.Add(23)
+	assertJSON(t, g, h{"type": "g", "value": 23, "mean": 24, "min": 23, "max": 25})
+	g.(interface{ Reset() }).Reset()
+	assertJSON(t, g, h{"type": "g", "value": 20, "mean": 20, "min": 20, "max": 20})
+
+	now = mockTime(0)
+	tl := NewGaugeWith(GaugeOptions{Initial: &initial}, "2s1s")
+	tl.Add(10)
+	assertJSON(t, tl, h{"interval": 1,
+		"total": h{"type": "g", "value": 10, "mean": 10, "min": 10, "max": 10},
+		"samples": v{
+			h{"type": "g", "value": 10, "mean": 10, "min": 10, "max": 10},
+			h{"type": "g", "value": 20, "mean": 20, "min": 20, "max": 20},
+		}})
+}
+
+func TestGaugeThreshold(t *testing.T) {
+	g := NewGaugeWith(GaugeOptions{Threshold: &Threshold{Warn: 80, Crit: 95}})
+	for _, test := range []struct {
+		Value  float64
+		Status string
+	}{{10, "ok"}, {80, "warn"}, {90, "warn"}, {99, "crit"}, {50, "ok"}} {
+		g.Add(test.Value)
+		if s := g.(*gauge).opts.Threshold.status(test.Value); s != test.Status {
+			t.Fatal(test, s)
+		}
+	}
+	assertJSON(t, g, h{"type": "g", "value": 50, "mean": 65.8, "min": 10, "max": 99, "status": "ok"})
+
+	free := NewGaugeWith(GaugeOptions{Threshold: &Threshold{Warn: 10, Crit: 5}})
+	free.Add(7)
+	assertJSON(t, free, h{"type": "g", "value": 7, "mean": 7, "min": 7, "max": 7, "status": "warn"})
+	free.Add(3)
+	assertJSON(t, free, h{"type": "g", "value": 3, "mean": 5, "min": 3, "max": 7, "status": "crit"})
+}
+
+func TestMeanGauge(t *testing.T) {
+	g := NewMeanGauge()
+	assertJSON(t, g, h{"type": "g", "mean": 0})
+	g.Add(1)
+	g.Add(5)
+	assertJSON(t, g, h{"type": "g", "mean": 3})
+	if s := g.String(); s != "3" {
+		t.Fatal(s)
+	}
+
+	now = mockTime(0)
+	tl := NewMeanGauge("3s1s")
+	tl.Add(2)
+	now = mockTime(1)
+	tl.Add(4)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "g", "mean": 3},
+		"samples": v{h{"type": "g", "mean": 4}, h{"type": "g", "mean": 2}, h{"type": "g", "mean": 0}}})
+	now = mockTime(3)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "g", "mean": 4},
+		"samples": v{h{"type": "g", "mean": 0}, h{"type": "g", "mean": 0}, h{"type": "g", "mean": 4}}})
+}
+
+func TestHistogram(t *testing.T) {
+	hist := NewHistogram()
+	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0})
+	hist.Add(1)
+	assertJSON(t, hist, h{"type": "h", "p50": 1, "p90": 1, "p99": 1, "min": 1, "max": 1, "mean": 1})
+	for i := 2; i < 100; i++ {
+		hist.Add(float64(i))
+	}
+	assertJSON(t, hist, h{"type": "h", "p50": 50, "p90": 90, "p99": 99, "min": 1, "max": 99, "mean": 50,
+		"p50_err": 1, "p90_err": 1, "p99_err": 0.5})
+	// Zero mean of non-empty histograms is reported, too
+	sym := NewHistogram()
+	sym.Add(-1)
+	sym.Add(1)
+	assertJSON(t, sym, h{"type": "h", "p50": -1, "p90": 1, "p99": 1, "min": -1, "max": 1, "mean": 0,
+		"p50_err": 1, "p90_err": 1, "p99_err": 1})
+}
+
+func TestDurationHistogram(t *testing.T) {
+	hist := NewDurationHistogram()
+	hist.Add(0.012)
+	assertJSON(t, hist, h{"type": "h", "p50": 0.012, "p90": 0.012, "p99": 0.012, "min": 0.012, "max": 0.012, "mean": 0.012,
+		"p50_str": "12ms", "p90_str": "12ms", "p99_str": "12ms"})
+	for _, test := range []struct {
+		Seconds float64
+		Str     string
+	}{{0, "0s"}, {1.3, "1.3s"}, {1.23456, "1.23s"}, {0.0123456, "12.35ms"}, {0.0000015, "1.5µs"}, {90, "1m30s"}} {
+		if s := seconds(test.Seconds); s != test.Str {
+			t.Fatal(test.Seconds, s, test.Str)
+		}
+	}
+}
+
+func TestHistogramWeighted(t *testing.T) {
+	hist := NewHistogram().(Histogram)
+	hist.AddWeighted(1, 50)
+	hist.AddWeighted(2, 40)
+	hist.AddWeighted(3, 10)
+	hist.AddWeighted(100, 0)
+	hist.AddWeighted(100, -1)
+	assertJSON(t, hist, h{"type": "h", "p50": 1, "p90": 2, "p99": 3, "min": 1, "max": 3, "mean": 1.6,
+		"p50_err": 0.5, "p90_err": 1, "p99_err": 0.5})
+
+	now = mockTime(0)
+	tl := NewHistogram("3s1s").(Histogram)
+	tl.AddWeighted(5, 9)
+	tl.AddWeighted(7, 1)
+	if s := tl.String(); s != `{"type":"h","p50":5,"p90":5,"p99":7,"min":5,"max":7,"mean":5.2,"p50_err":1,"p90_err":1,"p99_err":1}` {
+		t.Fatal(s)
+	}
+}
+
+func TestHistogramAddPairs(t *testing.T) {
+	hist := NewHistogram().(Histogram)
+	hist.Add(2)
+	hist.AddPairs([]Bin{{Value: 3, Count: 10}, {Value: 1, Count: 50}, {Value: 100, Count: 0}, {Value: 2, Count: 39}})
+	assertJSON(t, hist, h{"type": "h", "p50": 1, "p90": 2, "p99": 3, "min": 1, "max": 3, "mean": 1.6,
+		"p50_err": 0.5, "p90_err": 0.5, "p99_err": 0.5})
+	if total := hist.(*histogram).total; total != 100 {
+		t.Fatal(total)
+	}
+
+	pairs := []Bin{}
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, Bin{Value: float64(i), Count: 1})
+	}
+
+	// Bulk loads are trimmed as they go, so bins never grow far past maxBins
+	bulk := NewHistogram().(*histogram)
+	large := []Bin{}
+	for _, x := range rand.Perm(10000) {
+		large = append(large, Bin{Value: float64(x), Count: 1})
+	}
+	bulk.AddPairs(large)
+	if n := cap(bulk.bins); n > 3*maxBins {
+		t.Fatal(n)
+	}
+	if fromBins := NewHistogramFromBins(large).(*histogram); cap(fromBins.bins) > 3*maxBins {
+		t.Fatal(cap(fromBins.bins))
+	}
+	if p50 := bulk.Quantile(0.5); math.Abs(p50-5000) > 200 {
+		t.Fatal(p50)
+	}
+
+	tl := NewHistogram("3s1s", "10s1s").(Histogram)
+	tl.AddPairs(pairs)
+	if p50 := tl.Quantile(0.5); math.Abs(p50-500) > 10 {
+		t.Fatal(p50)
+	}
+}
+
+func TestAddPromBuckets(t *testing.T) {
+	hist := NewHistogram().(Histogram)
+	AddPromBuckets(hist, []PromBucket{{math.Inf(1), 100}, {0.25, 10}, {0.5, 60}, {1, 90}})
+	if bins := hist.(*histogram).bins; !reflect.DeepEqual(bins, []Bin{{0.125, 10}, {0.375, 50}, {0.75, 30}, {1, 10}}) {
+		t.Fatal(bins)
+	}
+	AddPromBuckets(hist, nil)
+	if total := hist.(*histogram).total; total != 100 {
+		t.Fatal(total)
+	}
+}
+
+func TestTrend(t *testing.T) {
+	now = mockTime(0)
+	hist := NewHistogram("10s1s")
+	if severity, alert := Trend(hist, TrendOptions{}); severity != 0 || alert {
+		t.Fatal(severity, alert)
+	}
+	for i := 0; i < 5; i++ {
+		now = mockTime(i)
+		hist.Add(10)
+		hist.Add(float64(10 + i))
+	}
+	if severity, alert := Trend(hist, TrendOptions{}); severity != 14/11.5 || alert {
+		t.Fatal(severity, alert)
+	}
+	// Empty samples are not part of the baseline
+	now = mockTime(7)
+	hist.Add(50)
+	if severity, alert := Trend(hist, TrendOptions{}); severity != 50.0/12 || !alert {
+		t.Fatal(severity, alert)
+	}
+	opts := TrendOptions{
+		Quantile: 0.5,
+		Baseline: func(q []float64) float64 { return q[0] },
+		Compare:  func(current, baseline float64) float64 { return current - baseline },
+		Limit:    30,
+	}
+	if severity, alert := Trend(hist, opts); severity != 40 || !alert {
+		t.Fatal(severity, alert)
+	}
+	// The current sample is empty
+	now = mockTime(8)
+	if severity, alert := Trend(hist, TrendOptions{}); severity != 0 || alert {
+		t.Fatal(severity, alert)
+	}
+	if _, alert := Trend(NewCounter("10s1s"), TrendOptions{}); alert {
+		t.Fatal(alert)
+	}
+}
+
+func TestWeightedQuantile(t *testing.T) {
+	now = mockTime(0)
+	hist := NewHistogram("5s1s", "10s1s")
+	for i := 0; i < 10; i++ {
+		hist.Add(100)
+	}
+	now = mockTime(1)
+	for i := 0; i < 10; i++ {
+		hist.Add(1)
+	}
+	if x := WeightedQuantile(hist, 0.9, 1); x != 100 {
+		t.Fatal(x)
+	}
+	if x := WeightedQuantile(hist, 0.9, 0.1); x != 1 {
+		t.Fatal(x)
+	}
+	if x := WeightedQuantile(NewCounter("5s1s"), 0.9, 1); x != 0 {
+		t.Fatal(x)
+	}
+}
+
+func TestQuantileRange(t *testing.T) {
+	for _, hist := range []Histogram{
+		NewHistogram().(Histogram),
+		NewHistogram32().(Histogram),
+		NewRelativeHistogram(0.01).(Histogram),
+		NewHistogram("10s1s").(Histogram),
+	} {
+		for i := 1; i <= 10; i++ {
+			hist.Add(float64(i))
+		}
+		if min, max := hist.Quantile(-1), hist.Quantile(2); min != 1 || max != 10 {
+			t.Fatal(hist, min, max)
+		}
+		if x := hist.Quantile(math.NaN()); !math.IsNaN(x) {
+			t.Fatal(hist, x)
+		}
+	}
+	for _, q := range []float64{0, 1, 1.5, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal(q)
+				}
+			}()
+			NewPSquare(q)
+		}()
+	}
+}
+
+func TestMode(t *testing.T) {
+	for _, hist := range []Histogram{
+		NewHistogram().(Histogram),
+		NewHistogram32().(Histogram),
+		NewRelativeHistogram(0.01).(Histogram),
+		NewHistogram("10s1s", "1m10s").(Histogram),
+	} {
+		if m := hist.Mode(); m != 0 {
+			t.Fatal(m)
+		}
+		// A cache makes many requests fast, so the median hides the peak
+		for i := 0; i < 10; i++ {
+			for _, x := range []float64{0.1, 0.1, 0.1, 0.1, 1, 1, 1, 2, 2, 2} {
+				hist.Add(x)
+			}
+		}
+		if p50, m := hist.Quantile(0.5), hist.Mode(); math.Abs(m-0.1) > 0.001 || p50 == m {
+			t.Fatal(p50, m)
+		}
+		hist.AddWeighted(2, 100)
+		if m := hist.Mode(); math.Abs(m-2) > 0.02 {
+			t.Fatal(m)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	for _, hist := range []Histogram{
+		NewHistogram().(Histogram),
+		NewHistogramWith(HistogramOptions{LogScale: true}).(Histogram),
+		NewHistogram32().(Histogram),
+		NewRelativeHistogram(0.01).(Histogram),
+		NewHistogram("10s1s", "1m1s").(Histogram),
+	} {
+		if r := hist.Rank(1); r != 0 {
+			t.Fatal(hist, r)
+		}
+		for i := 1; i <= 100; i++ {
+			hist.Add(float64(i))
+		}
+		for _, test := range []struct{ Value, Rank float64 }{{0, 0}, {10, 0.1}, {90, 0.9}, {100, 1}, {1000, 1}} {
+			if r := hist.Rank(test.Value); math.Abs(r-test.Rank) > 0.02 {
+				t.Fatal(hist, test, r)
+			}
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := NewHistogram().(Histogram), NewHistogram("10s1s").(Histogram)
+	for i := 1; i <= 50; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i + 50))
+	}
+	merged := NewRelativeHistogram(0.01).(Histogram)
+	Merge(merged, a)
+	Merge(merged, b)
+	if p50, p90 := merged.Quantile(0.5), merged.Quantile(0.9); math.Abs(p50-50) > 2 || math.Abs(p90-90) > 2 {
+		t.Fatal(p50, p90)
+	}
+
+	// Merging in opposite directions concurrently must not deadlock
+	var wg sync.WaitGroup
+	for _, pair := range [][2]Histogram{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func(dst, src Histogram) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				Merge(dst, src)
+			}
+		}(pair[0], pair[1])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestIQR(t *testing.T) {
+	hist := NewHistogram("10s1s").(Histogram)
+	for i := 1; i <= 100; i++ {
+		hist.Add(float64(i))
+	}
+	if iqr := IQR(hist); iqr != 50 {
+		t.Fatal(iqr)
+	}
+	if iqr := IQR(NewRelativeHistogram(0.01).(Histogram)); iqr != 0 {
+		t.Fatal(iqr)
+	}
+}
+
+func TestHistogramFromBins(t *testing.T) {
+	hist := NewHistogramFromBins([]Bin{{Value: 10, Count: 1}, {Value: 1, Count: 8}, {Value: 5, Count: 1}, {Value: 7}})
+	for _, test := range []struct{ Q, Value float64 }{{0, 1}, {0.5, 1}, {0.8, 1}, {0.81, 5}, {0.9, 5}, {0.91, 10}, {1, 10}} {
+		if v := hist.Quantile(test.Q); v != test.Value {
+			t.Fatal(test.Q, v, test.Value)
+		}
+	}
+	assertJSON(t, hist, h{"type": "h", "p50": 1, "p90": 5, "p99": 10, "min": 1, "max": 10, "mean": 2.3,
+		"p50_err": 2, "p90_err": 4.5, "p99_err": 2.5})
+
+	bins := []Bin{}
+	for i := 0; i < 1000; i++ {
+		bins = append(bins, Bin{Value: float64(i), Count: 1})
+	}
+	if n := len(NewHistogramFromBins(bins).(*histogram).bins); n != maxBins {
+		t.Fatal(n)
+	}
+}
+
+func TestHistogramResetAllocs(t *testing.T) {
+	hist := &histogram{}
+	fill := func() {
+		hist.Reset()
+		for i := 0; i < maxBins*2; i++ {
+			hist.Add(float64(i % 7 * i))
+		}
+	}
+	fill()
+	if n := testing.AllocsPerRun(10, fill); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestHistogramExact(t *testing.T) {
+	hist := NewHistogramWith(HistogramOptions{Exact: 1000}).(Histogram)
+	r := rand.New(rand.NewSource(1))
+	values := r.Perm(1000)
+	for _, x := range values {
+		hist.Add(float64(x))
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		if x := hist.Quantile(q); x != math.Ceil(q*1000)-1 {
+			t.Fatal(q, x)
+		}
+	}
+	b, _ := json.Marshal(hist)
+	if strings.Contains(string(b), "_err") {
+		t.Fatal(string(b))
+	}
+	hist.Add(1000)
+	if n := len(hist.(*histogram).bins); n != maxBins {
+		t.Fatal(n)
+	}
+	if b, _ := json.Marshal(hist); !strings.Contains(string(b), `"p50_err"`) {
+		t.Fatal(string(b))
+	}
+}
+
+func TestHistogramExactTimeline(t *testing.T) {
+	// The decaying timeline total must stop being exact once it has seen
+	// more distinct values than allowed
+	r := rand.New(rand.NewSource(1))
+	hist := NewHistogramWith(HistogramOptions{Exact: 1000}, "15m10s").(*timeseries)
+	for i := 0; i < 3600; i++ {
+		now = mockTime(i)
+		hist.Add(r.Float64())
+	}
+	total := hist.total.(*histogram)
+	if n := len(total.bins); n > 1000 {
+		t.Fatal(n, total.total)
+	}
+	for _, s := range hist.samples {
+		if n := len(s.(*histogram).bins); n > 10 {
+			t.Fatal(n)
+		}
+	}
+}
+
+func TestHistogramDuplicates(t *testing.T) {
+	hist := NewHistogram().(*histogram)
+	for i := 0; i < 1000; i++ {
+		hist.Add(5)
+	}
+	if !reflect.DeepEqual(hist.bins, []Bin{{5, 1000}}) {
+		t.Fatal(hist.bins)
+	}
+	assertJSON(t, hist, h{"type": "h", "p50": 5, "p90": 5, "p99": 5, "min": 5, "max": 5, "mean": 5})
+}
+
+func TestHistogramKeepBins(t *testing.T) {
+	hist := NewHistogramWith(HistogramOptions{KeepBins: true}).(*histogram)
+	r := rand.New(rand.NewSource(1))
+	for _, x := range r.Perm(1000) {
+		hist.Add(float64(x))
+	}
+	values := []float64{}
+	for _, b := range hist.bins {
+		values = append(values, b.Value)
+	}
+	hist.Reset()
+	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0})
+	for _, x := range r.Perm(100) {
+		hist.Add(float64(x + 100))
+	}
+	if len(hist.bins) != len(values) {
+		t.Fatal(len(hist.bins))
+	}
+	for i, b := range hist.bins {
+		if b.Value != values[i] {
+			t.Fatal(i, b.Value, values[i])
+		}
+	}
+	if p50, min, max := hist.Quantile(0.5), hist.min(), hist.max(); math.Abs(p50-150) > 20 || min < 90 || max > 210 {
+		t.Fatal(p50, min, max)
+	}
+}
+
+func TestHistogram32(t *testing.T) {
+	hist := NewHistogram32().(Histogram)
+	for i := 1; i <= 1000; i++ {
+		hist.Add(float64(i))
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		if x := hist.Quantile(q); math.Abs(x-q*1000) > 20 {
+			t.Fatal(q, x)
+		}
+	}
+	if n := len(hist.(*histogram32).bins); n != maxBins {
+		t.Fatal(n)
+	}
+	if size := unsafe.Sizeof(bin32{}); size*2 != unsafe.Sizeof(Bin{}) {
+		t.Fatal(size)
+	}
+
+	// Saturated float32 counts must not break quantiles and mean
+	sat := NewHistogram32().(Histogram)
+	sat.AddWeighted(1, 1<<24)
+	for i := 0; i < 1<<22; i++ {
+		sat.Add(1)
+	}
+	sat.Add(2)
+	assertJSON(t, sat, h{"type": "h", "p50": 1, "p90": 1, "p99": 1, "min": 1, "max": 2, "mean": 1 + 1.0/(1<<24+1)})
+	if x := sat.Quantile(1); x != 2 {
+		t.Fatal(x)
+	}
+
+	now = mockTime(0)
+	tl := NewHistogram32("3s1s").(Histogram)
+	tl.AddPairs([]Bin{{1, 2}, {3, 1}})
+	assertJSON(t, tl, h{"interval": 1,
+		"total": h{"type": "h", "p50": 1, "p90": 3, "p99": 3, "min": 1, "max": 3, "mean": 5.0 / 3},
+		"samples": v{
+			h{"type": "h", "p50": 1, "p90": 3, "p99": 3, "min": 1, "max": 3, "mean": 5.0 / 3},
+			h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0},
+			h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0},
+		}})
+}
+
+func TestQuantileMethod(t *testing.T) {
+	for _, test := range []struct {
+		Method QuantileMethod
+		Values []float64
+	}{
+		{QuantileBin, []float64{1, 5, 9, 10, 10}},
+		{QuantileNearestRank, []float64{1, 5, 9, 10, 10}},
+		{QuantileLinear, []float64{1, 5.5, 9.1, 9.91, 10}},
+	} {
+		hist := NewHistogramWith(HistogramOptions{Exact: 10, Method: test.Method}).(Histogram)
+		for i := 10; i >= 1; i-- {
+			hist.Add(float64(i))
+		}
+		for i, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+			if x := hist.Quantile(q); math.Abs(x-test.Values[i]) > 1e-9 {
+				t.Fatal(test.Method, q, x)
+			}
+		}
+	}
+
+	// Methods differ for fractional counts
+	for method, expect := range map[QuantileMethod]float64{QuantileBin: 1, QuantileNearestRank: 2, QuantileLinear: 1.5} {
+		hist := NewHistogramWith(HistogramOptions{Method: method}).(Histogram)
+		hist.AddWeighted(1, 0.5)
+		hist.AddWeighted(2, 0.5)
+		if x := hist.Quantile(0.5); x != expect {
+			t.Fatal(method, x)
+		}
+	}
+}
+
+func TestHistogramLogScale(t *testing.T) {
+	hist := NewHistogramWith(HistogramOptions{LogScale: true}).(Histogram)
+	hist.Add(0)
+	hist.Add(-1)
+	values := []float64{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		x := math.Exp(r.NormFloat64()*2 - 5)
+		values = append(values, x)
+		hist.Add(x)
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		x, exact := hist.Quantile(q), values[int(q*float64(len(values)))-1]
+		if math.Abs(x-exact)/exact > 0.1 {
+			t.Fatal(q, x, exact)
+		}
+	}
+	var hj HistogramJSON
+	b, _ := json.Marshal(hist)
+	json.Unmarshal(b, &hj)
+	if !(hj.Min > 0 && hj.Min < hj.P50 && hj.Max > hj.P99) {
+		t.Fatal(string(b))
+	}
+}
+
+func TestHistogramNormalDist(t *testing.T) {
+	hist := NewHistogram()
+	rand.Seed(time.Now().UnixNano())
+	for i := 0; i < 10000; i++ {
+		hist.Add(rand.Float64() * 10)
+	}
+	b, _ := json.Marshal(hist)
+	p := h{}
+	json.Unmarshal(b, &p)
+	if math.Abs(p["p50"].(float64)-5) > 0.5 {
+		t.Fatal(p["p50"])
+	}
+	if math.Abs(p["p90"].(float64)-9) > 0.5 {
+		t.Fatal(p["p90"])
+	}
+	if math.Abs(p["p99"].(float64)-10) > 0.5 {
+		t.Fatal(p["p99"])
+	}
+}
+
+func TestDerivative(t *testing.T) {
+	now = mockTime(0)
+	d := NewDerivative()
+	d.Add(100)
+	assertJSON(t, d, h{"type": "deriv", "rate": 0})
+	now = mockTime(2)
+	d.Add(300)
+	assertJSON(t, d, h{"type": "deriv", "rate": 100})
+	now = mockTime(3)
+	d.Add(250)
+	if s := d.String(); s != "-50" {
+		t.Fatal(s)
+	}
+
+	now = mockTime(0)
+	tl := NewDerivative("3s1s")
+	tl.Add(10)
+	now = mockTime(1)
+	tl.Add(20)
+	now = mockTime(2)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "deriv", "rate": 10}, "samples": v{
+		h{"type": "deriv", "rate": 0}, h{"type": "deriv", "rate": 10}, h{"type": "deriv", "rate": 0},
+	}})
+	now = mockTime(10)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "deriv", "rate": 0}, "samples": v{
+		h{"type": "deriv", "rate": 0}, h{"type": "deriv", "rate": 0}, h{"type": "deriv", "rate": 0},
+	}})
+}
+
+func TestAcceleration(t *testing.T) {
+	now = mockTime(0)
+	a := NewAcceleration()
+	a.Add(0)
+	now = mockTime(1)
+	a.Add(10)
+	assertJSON(t, a, h{"type": "accel", "rate": 10, "accel": 0})
+	now = mockTime(2)
+	a.Add(30)
+	assertJSON(t, a, h{"type": "accel", "rate": 20, "accel": 10})
+	now = mockTime(4)
+	a.Add(50)
+	assertJSON(t, a, h{"type": "accel", "rate": 10, "accel": -5})
+
+	now = mockTime(0)
+	tl := NewAcceleration("3s1s")
+	tl.Add(0)
+	now = mockTime(1)
+	tl.Add(10)
+	now = mockTime(2)
+	tl.Add(30)
+	now = mockTime(3)
+	tl.Add(60)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "accel", "rate": 30, "accel": 10}, "samples": v{
+		h{"type": "accel", "rate": 30, "accel": 10}, h{"type": "accel", "rate": 20, "accel": 10},
+		h{"type": "accel", "rate": 10, "accel": 0},
+	}})
+	now = mockTime(10)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"type": "accel", "rate": 0, "accel": 0}, "samples": v{
+		h{"type": "accel", "rate": 0, "accel": 0}, h{"type": "accel", "rate": 0, "accel": 0},
+		h{"type": "accel", "rate": 0, "accel": 0},
+	}})
+}
+
+func TestRateUnit(t *testing.T) {
+	now = mockTime(0)
+	c := RateUnit(NewRateCounter(), time.Minute)
+	c.Add(60)
+	assertJSON(t, c, h{"type": "rc", "count": 60, "rate": 60, "unit": "per_minute"})
+
+	now = mockTime(0)
+	a := RateUnit(NewAcceleration("3s1s"), time.Minute)
+	a.Add(0)
+	now = mockTime(1)
+	a.Add(10)
+	now = mockTime(2)
+	a.Add(30)
+	assertJSON(t, a, h{"interval": 1,
+		"total": h{"type": "accel", "rate": 1200, "accel": 36000, "unit": "per_minute"},
+		"samples": v{
+			h{"type": "accel", "rate": 1200, "accel": 36000, "unit": "per_minute"},
+			h{"type": "accel", "rate": 600, "accel": 0, "unit": "per_minute"},
+			h{"type": "accel", "rate": 0, "accel": 0, "unit": "per_minute"},
+		}})
+	if r := RateUnit(NewDerivative(), 5*time.Second).(rateUnit); r.name() != "per_5s" {
+		t.Fatal(r.name())
+	}
+	if _, ok := versionOf(a); !ok {
+		t.Fatal("version")
+	}
+	// Scaled rates respect PlainFloats
+	PlainFloats = true
+	defer func() { PlainFloats = false }()
+	now = mockTime(0)
+	d := RateUnit(NewDerivative(), time.Minute)
+	d.Add(0)
+	now = mockTime(1)
+	d.Add(1e-8)
+	b, _ := json.Marshal(d)
+	var rate struct{ Rate json.Number }
+	if err := json.Unmarshal(b, &rate); err != nil || strings.ContainsAny(string(rate.Rate), "eE") {
+		t.Fatal(string(b), err)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	top := NewTopK(2)
+	for _, key := range []string{"a", "b", "a", "c", "a", "c", "c", "c"} {
+		top.Inc(key)
+	}
+	// "c" evicted "b" and inherited its count as the error bound
+	assertJSON(t, top, h{"type": "topk", "items": v{
+		h{"key": "c", "count": 5, "error": 1},
+		h{"key": "a", "count": 3, "error": 0},
+	}})
+	top.Add(404)
+	assertJSON(t, top, h{"type": "topk", "items": v{
+		h{"key": "c", "count": 5, "error": 1},
+		h{"key": "404", "count": 4, "error": 3},
+	}})
+}
+
+// maxMetric is a custom metric that keeps the largest value.
+type maxMetric struct{ max float64 }
+
+func (m *maxMetric) Add(n float64)  { m.max = math.Max(m.max, n) }
+func (m *maxMetric) String() string { return strconv.FormatFloat(m.max, 'g', -1, 64) }
+func (m *maxMetric) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{"max": m.max})
+}
+func (m *maxMetric) Aggregate(roll int, samples []Metric) {
+	m.max = 0
+	for _, s := range samples {
+		m.max = math.Max(m.max, s.(*maxMetric).max)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	now = mockTime(0)
+	tl := NewTimeline(func() Metric { return &maxMetric{} }, "2s1s")
+	tl.Add(3)
+	tl.Add(1)
+	now = mockTime(1)
+	tl.Add(2)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"max": 3}, "samples": v{h{"max": 2}, h{"max": 3}}})
+	now = mockTime(2)
+	tl.Add(1)
+	assertJSON(t, tl, h{"interval": 1, "total": h{"max": 2}, "samples": v{h{"max": 1}, h{"max": 2}}})
+
+	now = mockTime(0)
+	top := NewTimeline(func() Metric { return NewTopK(1) }, "2s1s")
+	top.Add(404)
+	now = mockTime(1)
+	top.Add(500)
+	assertJSON(t, top, h{"interval": 1,
+		"total":   h{"type": "topk", "items": v{h{"key": "500", "count": 2, "error": 1}}},
+		"samples": v{h{"type": "topk", "items": v{h{"key": "500", "count": 1, "error": 0}}}, h{"type": "topk", "items": v{h{"key": "404", "count": 1, "error": 0}}}}})
+
+	// Custom metrics don't have to be safe for concurrent use
+	now = mockTime(0)
+	concurrent := NewTimeline(func() Metric { return &maxMetric{} }, "2s1s")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				concurrent.Add(float64(i*100 + j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assertJSON(t, concurrent, h{"interval": 1, "total": h{"max": 399}, "samples": v{h{"max": 399}, h{"max": 0}}})
+}
+
+func TestTypedJSON(t *testing.T) {
+	now = mockTime(0)
+	hist := NewDurationHistogram("3s1s")
+	hist.Add(0.5)
+	b, _ := json.Marshal(hist)
+	var tl TimelineJSON
+	var total, sample HistogramJSON
+	if err := json.Unmarshal(b, &tl); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(tl.Total, &total); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(tl.Samples[0], &sample); err != nil {
+		t.Fatal(err)
+	}
+	if tl.Interval != 1 || len(tl.Samples) != 3 || total.P99 != 0.5 || sample.P50Str != "500ms" {
+		t.Fatal(tl, total, sample)
+	}
+	var c CounterJSON
+	b, _ = json.Marshal(NewCounter())
+	if err := json.Unmarshal(b, &c); err != nil || c.Type != "c" {
+		t.Fatal(c, err)
+	}
+	var g GaugeJSON
+	b, _ = json.Marshal(NewGauge())
+	if err := json.Unmarshal(b, &g); err != nil || g.Type != "g" {
+		t.Fatal(g, err)
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	for name, expect := range map[string]string{
+		"requests":     "requests",
+		"fib:rec:sec":  "fib_rec_sec",
+		"http-latency": "http_latency",
+		"a::b--c__d":   "a_b_c_d",
+		"5xx":          "_5xx",
+		"api.v1.req":   "api_v1_req",
+		"":             "_",
+	} {
+		if s := PrometheusName(name); s != expect {
+			t.Fatal(name, s)
+		}
+	}
+	var b strings.Builder
+	WritePrometheus(&b, map[string]Metric{"fib:rec": NewCounter(), "fib-rec": NewCounter(), "2xx": NewCounter()})
+	if s := b.String(); s != "# TYPE _2xx counter\n_2xx 0\n# TYPE fib_rec counter\nfib_rec 0\n" {
+		t.Fatal(s)
+	}
+	// Timeline totals decrease when samples roll out
+	b.Reset()
+	WritePrometheus(&b, map[string]Metric{"c": NewCounter("10s1s"), "m": NewCounter("10s1s", "1m10s")})
+	if s := b.String(); s != "# TYPE c gauge\nc 0\n# TYPE m gauge\nm 0\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestRateCounter(t *testing.T) {
+	now = mockTime(0)
+	c := NewRateCounter()
+	assertJSON(t, c, h{"type": "rc", "count": 0, "rate": 0})
+	for i := 0; i < 600; i++ {
+		now = mockTime(i)
+		c.Add(1)
+	}
+	var rc struct{ Count, Rate float64 }
+	b, _ := json.Marshal(c)
+	json.Unmarshal(b, &rc)
+	if rc.Count != 600 || math.Abs(rc.Rate-1) > 0.02 {
+		t.Fatal(rc)
+	}
+	if s := c.String(); s != "600" {
+		t.Fatal(s)
+	}
+	// The rate fades out without events
+	now = mockTime(599 + 60)
+	b, _ = json.Marshal(c)
+	json.Unmarshal(b, &rc)
+	if rc.Count != 600 || math.Abs(rc.Rate-math.Exp(-1)) > 0.02 {
+		t.Fatal(rc)
+	}
+
+	now = mockTime(0)
+	tl := NewRateCounter("3s1s")
+	for i := 0; i < 10; i++ {
+		tl.Add(6)
+	}
+	now = mockTime(1)
+	tl.Add(6)
+	// Rates are reported as of now, so the previous sample has faded a bit
+	var timeline struct {
+		Total   struct{ Count, Rate float64 }
+		Samples []struct{ Count, Rate float64 }
+	}
+	b, _ = json.Marshal(tl)
+	json.Unmarshal(b, &timeline)
+	decayed := math.Exp(-1.0 / 60)
+	for i, expect := range []struct{ Count, Rate float64 }{{66, decayed + 0.1}, {6, decayed + 0.1}, {60, decayed}, {0, 0}} {
+		actual := timeline.Total
+		if i > 0 {
+			actual = timeline.Samples[i-1]
+		}
+		if actual.Count != expect.Count || math.Abs(actual.Rate-expect.Rate) > 1e-9 {
+			t.Fatal(i, actual, expect)
+		}
+	}
+}
+
+func TestPSquare(t *testing.T) {
+	ps := NewPSquare(0.9)
+	for _, v := range []float64{5, 1, 3} {
+		ps.Add(v)
+	}
+	assertJSON(t, ps, h{"type": "p2", "p": 0.9, "value": 5})
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		ps.Add(r.Float64() * 100)
+	}
+	if v, _ := strconv.ParseFloat(ps.String(), 64); math.Abs(v-90) > 2 {
+		t.Fatal(v)
+	}
+	var b strings.Builder
+	WritePrometheus(&b, map[string]Metric{"p": NewPSquare(0.99)})
+	if s := b.String(); s != "# TYPE p summary\np{quantile=\"0.99\"} 0\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	now = mockTime(0)
+	hm := NewHeatmap([]float64{1, 0.1}, "2s1s")
+	hm.Add(0.05)
+	hm.Add(0.5)
+	now = mockTime(1)
+	hm.Add(1)
+	hm.Add(5)
+	assertJSON(t, hm, h{"interval": 1,
+		"total": h{"type": "hm", "bounds": v{0.1, 1}, "counts": v{1, 2, 1}, "sum": 6.55},
+		"samples": v{
+			h{"type": "hm", "bounds": v{0.1, 1}, "counts": v{0, 1, 1}, "sum": 6},
+			h{"type": "hm", "bounds": v{0.1, 1}, "counts": v{1, 1, 0}, "sum": 0.55},
+		}})
+	var b strings.Builder
+	WritePrometheus(&b, map[string]Metric{"hm": hm})
+	if s := b.String(); s != `# TYPE hm histogram
+hm_bucket{le="0.1"} 1
+hm_bucket{le="1"} 3
+hm_bucket{le="+Inf"} 4
+hm_sum 6.55
+hm_count 4
+` {
+		t.Fatal(s)
+	}
+}
+
+func TestRelativeHistogram(t *testing.T) {
+	hist := NewRelativeHistogram(0.01).(Histogram)
+	values := []float64{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		x := math.Exp(r.Float64()*20 - 10)
+		if i%10 == 0 {
+			x = -x
+		}
+		values = append(values, x)
+		hist.Add(x)
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0, 0.05, 0.5, 0.9, 0.99, 1} {
+		x, exact := hist.Quantile(q), values[int(q*float64(len(values)-1))]
+		if math.Abs(x-exact) > 0.01*math.Abs(exact) {
+			t.Fatal(q, x, exact)
+		}
+	}
+
+	now = mockTime(0)
+	tl := NewRelativeHistogram(0.05, "3s1s")
+	tl.Add(0)
+	tl.Add(10)
+	now = mockTime(1)
+	tl.Add(100)
+	b, _ := json.Marshal(tl)
+	var total struct {
+		Total   HistogramJSON
+		Samples []HistogramJSON
+	}
+	json.Unmarshal(b, &total)
+	if total.Total.Min != 0 || total.Total.Max != 100 || math.Abs(total.Total.P50-10) > 0.5 ||
+		total.Samples[0].P50 != 100 || total.Samples[1].Max != 10 {
+		t.Fatal(string(b))
+	}
+}
+
+func TestLabeled(t *testing.T) {
+	l := NewLabeled(func() Metric { return NewCounter() })
+	l.AddLabeled(1, map[string]string{"method": "GET", "code": "200"})
+	l.AddLabeled(2, map[string]string{"code": "200", "method": "GET"})
+	l.AddLabeled(1, map[string]string{"method": "POST", "code": "500"})
+	l.Add(5)
+	assertJSON(t, l, h{"type": "labeled", "children": v{
+		h{"labels": h{}, "metric": h{"type": "c", "count": 5}},
+		h{"labels": h{"code": "200", "method": "GET"}, "metric": h{"type": "c", "count": 3}},
+		h{"labels": h{"code": "500", "method": "POST"}, "metric": h{"type": "c", "count": 1}},
+	}})
+}
+
+func TestSlidingHistogram(t *testing.T) {
+	now = mockTime(0)
+	hist := NewSlidingHistogram(10 * time.Second)
+	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0})
+	for i := 1; i <= 10; i++ {
+		now = mockTime(i)
+		hist.Add(float64(i))
+	}
+	assertJSON(t, hist, h{"type": "h", "p50": 5, "p90": 9, "p99": 10, "min": 1, "max": 10, "mean": 5.5})
+	now = mockTime(15)
+	assertJSON(t, hist, h{"type": "h", "p50": 8, "p90": 10, "p99": 10, "min": 6, "max": 10, "mean": 8})
+	now = mockTime(30)
+	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0})
+}
+
+func TestMetricReset(t *testing.T) {
+	c := &counter{}
+	c.Add(5)
+	assertJSON(t, c, h{"type": "c", "count": 5})
+	c.Reset()
+	assertJSON(t, c, h{"type": "c", "count": 0})
+
+	g := &gauge{}
+	g.Add(5)
+	assertJSON(t, g, h{"type": "g", "mean": 5, "min": 5, "max": 5, "value": 5})
+	g.Reset()
+	assertJSON(t, g, h{"type": "g", "mean": 0, "min": 0, "max": 0, "value": 0})
+
+	hist := &histogram{}
+	hist.Add(5)
+	assertJSON(t, hist, h{"type": "h", "p50": 5, "p90": 5, "p99": 5, "min": 5, "max": 5, "mean": 5})
+	hist.Reset()
+	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0})
+}
+
+func TestMetricVerbose(t *testing.T) {
+	Verbose = true
+	defer func() { Verbose = false }()
+	now = mockTime(0)
+	c := NewCounter("3s1s")
+	c.Add(1)
+	assertJSON(t, c.(*timeseries).samples[0], h{"type": "c", "count": 1,
+		"_meta": h{"resets": 1, "last_reset": mockTime(0)().Unix()}})
+	now = mockTime(2)
+	c.Add(1)
+	// Each of the two rolls recycles the oldest sample as the newest one
+	assertJSON(t, c.(*timeseries).samples[0], h{"type": "c", "count": 1,
+		"_meta": h{"resets": 2, "last_reset": mockTime(2)().Unix()}})
+
+	g := &gauge{}
+	g.Reset()
+	g.Reset()
+	assertJSON(t, g, h{"type": "g", "mean": 0, "min": 0, "max": 0, "value": 0,
+		"_meta": h{"resets": 2, "last_reset": mockTime(2)().Unix()}})
+}
+
+func TestTimelineFirstLast(t *testing.T) {
+	Verbose = true
+	defer func() { Verbose = false }()
+	now = mockTime(0)
+	c := NewCounter("3s1s")
+	m := map[string]interface{}{}
+	b, _ := json.Marshal(c)
+	json.Unmarshal(b, &m)
+	if _, ok := m["first"]; ok {
+		t.Fatal(m)
+	}
+	c.Add(1)
+	now = mockTime(1)
+	c.Add(1)
+	now = mockTime(2)
+	c.Add(1)
+	b, _ = json.Marshal(c)
+	var tj TimelineJSON
+	json.Unmarshal(b, &tj)
+	if tj.First != mockTime(0)().Unix() || tj.Last != mockTime(2)().Unix() {
+		t.Fatal(string(b))
+	}
+	// The first sample rolls out, the last add is still reported after a gap
+	now = mockTime(3)
+	b, _ = json.Marshal(c)
+	tj = TimelineJSON{}
+	json.Unmarshal(b, &tj)
+	if tj.First != mockTime(1)().Unix() || tj.Last != mockTime(2)().Unix() {
+		t.Fatal(string(b))
+	}
+	now = mockTime(10)
+	b, _ = json.Marshal(c)
+	tj = TimelineJSON{}
+	json.Unmarshal(b, &tj)
+	if tj.First != 0 || tj.Last != 0 {
+		t.Fatal(string(b))
+	}
+}
+
+func TestWholeNumbers(t *testing.T) {
+	// Whole numbers are always marshaled without a fractional part
+	g := NewGauge()
+	g.Add(1)
+	g.Add(3)
+	if b, _ := json.Marshal(g); string(b) != `{"type":"g","value":3,"mean":2,"min":1,"max":3}` {
+		t.Fatal(string(b))
+	}
+	g.Add(1e20)
+	if b, _ := json.Marshal(g); !strings.Contains(string(b), `"max":100000000000000000000`) {
+		t.Fatal(string(b))
+	}
+}
+
+func TestPlainFloats(t *testing.T) {
+	g := NewGauge()
+	g.Add(1e21)
+	g.Add(-1e-7)
+	if b, _ := json.Marshal(g); string(b) != `{"type":"g","value":-1e-7,"mean":500000000000000000000,"min":-1e-7,"max":1e+21}` {
+		t.Fatal(string(b))
+	}
+	PlainFloats = true
+	defer func() { PlainFloats = false }()
+	if b, _ := json.Marshal(g); string(b) != `{"type":"g","value":-0.0000001,"mean":500000000000000000000,"min":-0.0000001,"max":1000000000000000000000}` {
+		t.Fatal(string(b))
+	}
+	if b := plainFloats([]byte(`{"a\"1e5":"2e3","b":[1E2,-3.5e-1]}`)); string(b) != `{"a\"1e5":"2e3","b":[100,-0.35]}` {
+		t.Fatal(string(b))
+	}
+}
+
+func TestMetricString(t *testing.T) {
+	c := NewCounter()
+	c.Add(1)
+	c.Add(3)
+	if s := c.String(); s != "4" {
+		t.Fatal(s)
+	}
+
+	g := NewGauge()
+	g.Add(1)
+	g.Add(3)
+	if s := g.String(); s != "3" {
+		t.Fatal(s)
+	}
+	// Scalar metrics are printed as values but marshaled as objects
+	if b, _ := json.Marshal(c); string(b) != `{"type":"c","count":4}` {
+		t.Fatal(string(b))
+	}
+	if b, _ := json.Marshal(g); string(b) != `{"type":"g","value":3,"mean":2,"min":1,"max":3}` {
+		t.Fatal(string(b))
+	}
+
+	hist := NewHistogram()
+	hist.Add(1)
+	hist.Add(3)
+	if s := hist.String(); s != `{"type":"h","p50":1,"p90":3,"p99":3,"min":1,"max":3,"mean":2,"p50_err":1,"p90_err":1,"p99_err":1}` {
+		t.Fatal(s)
+	}
+	if b, _ := json.Marshal(hist); string(b) != hist.String() {
+		t.Fatal(string(b))
+	}
+}
+
+func TestCounterTimeline(t *testing.T) {
+	now = mockTime(0)
+	c := NewCounter("3s1s")
+	expect := func(total float64, samples ...float64) h {
+		timeline := v{}
+		for _, s := range samples {
+			timeline = append(timeline, h{"type": "c", "count": s})
+		}
+		return h{
+			"interval": 1,
+			"total":    h{"type": "c", "count": total},
+			"samples":  timeline,
+		}
+	}
+	assertJSON(t, c, expect(0, 0, 0, 0))
+	c.Add(1)
+	assertJSON(t, c, expect(1, 1, 0, 0))
+	now = mockTime(1)
+	assertJSON(t, c, expect(1, 0, 1, 0))
+	c.Add(5)
+	assertJSON(t, c, expect(6, 5, 1, 0))
+	// String reports only the total, not the samples
+	if s := c.String(); s != "6" {
+		t.Fatal(s)
+	}
+	now = mockTime(3)
+	assertJSON(t, c, expect(5, 0, 0, 5))
+	if s := c.String(); s != "5" {
+		t.Fatal(s)
+	}
+	now = mockTime(10)
+	assertJSON(t, c, expect(0, 0, 0, 0))
+	if s := c.String(); s != "0" {
+		t.Fatal(s)
+	}
+}
+
+func TestGaugeTimeline(t *testing.T) {
+	now = mockTime(0)
+	g := NewGauge("3s1s")
+	gauge := func(value, min, max, mean float64) h {
+		return h{"type": "g", "value": value, "min": min, "max": max, "mean": mean}
+	}
+	expect := func(total h, samples ...h) h {
+		return h{"interval": 1, "total": total, "samples": samples}
+	}
+	assertJSON(t, g, expect(gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
+	g.Add(1)
+	assertJSON(t, g, expect(gauge(1, 1, 1, 1), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
+	now = mockTime(1)
+	assertJSON(t, g, expect(gauge(1, 1, 1, 1), gauge(0, 0, 0, 0), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0)))
+	g.Add(5)
+	assertJSON(t, g, expect(gauge(5, 1, 5, 3), gauge(5, 5, 5, 5), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0)))
+	now = mockTime(3)
+	assertJSON(t, g, expect(gauge(5, 5, 5, 5), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(5, 5, 5, 5)))
+	now = mockTime(10)
+	assertJSON(t, g, expect(gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
+}
+
+func TestHistogramTimeline(t *testing.T) {
+	now = mockTime(0)
+	hist := NewHistogram("3s1s")
+	histogram := func(p50, p90, p99, min, max, mean float64, errs ...float64) h {
+		x := h{"type": "h", "p50": p50, "p90": p90, "p99": p99, "min": min, "max": max, "mean": mean}
+		for i, k := range []string{"p50_err", "p90_err", "p99_err"}[:len(errs)] {
+			x[k] = errs[i]
+		}
+		return x
+	}
+	expect := func(total h, samples ...h) h {
+		return h{"interval": 1, "total": total, "samples": samples}
+	}
+	zero := histogram(0, 0, 0, 0, 0, 0)
+	assertJSON(t, hist, expect(zero, zero, zero, zero))
+	hist.Add(1)
+	assertJSON(t, hist, expect(histogram(1, 1, 1, 1, 1, 1), histogram(1, 1, 1, 1, 1, 1), zero, zero))
+	now = mockTime(1)
+	assertJSON(t, hist, expect(histogram(1, 1, 1, 1, 1, 1), zero, histogram(1, 1, 1, 1, 1, 1), zero))
+	hist.Add(3)
+	hist.Add(5)
+	assertJSON(t, hist, expect(histogram(3, 5, 5, 1, 5, 3.4, 2, 1, 1), histogram(3, 5, 5, 3, 5, 4, 1, 1, 1),
+		histogram(1, 1, 1, 1, 1, 1), zero))
+	now = mockTime(3)
+	assertJSON(t, hist, expect(histogram(3, 5, 5, 1, 5, 3.4, 2, 1, 1), zero, zero, histogram(3, 5, 5, 3, 5, 4, 1, 1, 1)))
+	now = mockTime(10)
+	assertJSON(t, hist, expect(zero, zero, zero, zero))
+}
+
+func TestPartialSample(t *testing.T) {
+	at := func(ms int) func() time.Time {
+		return func() time.Time { return time.Date(2017, 8, 11, 9, 0, 0, ms*int(time.Millisecond), time.UTC) }
+	}
+	now = at(200)
+	c := NewCounter("3s1s")
+	c.Add(1)
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 1}, "partial": 0,
+		"samples": v{h{"type": "c", "count": 1}, h{"type": "c", "count": 0}, h{"type": "c", "count": 0}}})
+	now = at(1200)
+	c.Add(2)
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 3}, "partial": 1,
+		"samples": v{h{"type": "c", "count": 2}, h{"type": "c", "count": 1}, h{"type": "c", "count": 0}}})
+	now = at(3000)
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 2},
+		"samples": v{h{"type": "c", "count": 0}, h{"type": "c", "count": 0}, h{"type": "c", "count": 2}}})
+
+	// Timelines created before the middle of the sample have no partial
+	// samples
+	now = at(0)
+	assertJSON(t, NewCounter("3s1s"), h{"interval": 1, "total": h{"type": "c", "count": 0},
+		"samples": v{h{"type": "c", "count": 0}, h{"type": "c", "count": 0}, h{"type": "c", "count": 0}}})
+	now = at(500)
+	assertJSON(t, NewCounter("3s1s"), h{"interval": 1, "total": h{"type": "c", "count": 0},
+		"samples": v{h{"type": "c", "count": 0}, h{"type": "c", "count": 0}, h{"type": "c", "count": 0}}})
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.wal")
+	now = mockTime(0)
+	j, err := OpenJournal(path, NewCounter("3s1s", "10s5s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Add(1)
+	now = mockTime(1)
+	j.Add(2)
+	now = mockTime(6)
+	j.Add(3)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A partially written record is ignored
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("15024420")
+	f.Close()
+
+	// After a restart the values land in the same samples
+	now = mockTime(7)
+	j, err = OpenJournal(path, NewCounter("3s1s", "10s5s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	assertJSON(t, j, h{"metrics": v{
+		h{"interval": 1, "total": h{"type": "c", "count": 3}, "samples": v{
+			h{"type": "c", "count": 0}, h{"type": "c", "count": 3}, h{"type": "c", "count": 0},
+		}},
+		h{"interval": 5, "partial": 0, "total": h{"type": "c", "count": 6}, "samples": v{
+			h{"type": "c", "count": 3}, h{"type": "c", "count": 3},
+		}},
+	}})
+
+	// Values beyond the longest timeline are dropped from the file
+	now = mockTime(12)
+	for i := 0; i < journalMinCompact; i++ {
+		j.Add(1)
+	}
+	if b, _ := os.ReadFile(path); strings.Count(string(b), "\n") != journalMinCompact+1 {
+		t.Fatal(strings.Count(string(b), "\n"))
+	}
+	j.Reset()
+	if b, _ := os.ReadFile(path); len(b) != 0 {
+		t.Fatal(string(b))
+	}
+
+	if _, err := OpenJournal(path, NewCounter()); err == nil {
+		t.Fatal("metric without frames")
+	}
+}
+
+func TestAddAt(t *testing.T) {
+	now = mockTime(5)
+	c := NewCounter("3s1s").(*timeseries)
+	c.AddAt(1, mockTime(5)())
+	c.AddAt(2, mockTime(4)())
+	c.AddAt(3, mockTime(3)())
+	c.AddAt(4, mockTime(2)())
+	c.AddAt(5, mockTime(6)())
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 6},
+		"samples": v{h{"type": "c", "count": 1}, h{"type": "c", "count": 2}, h{"type": "c", "count": 3}}})
+
+	m := NewGauge("3s1s", "10s5s").(multimetric)
+	m.AddAt(7, mockTime(1)())
+	assertJSON(t, m[0].total, h{"type": "g", "value": 0, "mean": 0, "min": 0, "max": 0})
+	assertJSON(t, m[1].samples[1], h{"type": "g", "value": 7, "mean": 7, "min": 7, "max": 7})
+}
+
+func TestMulti(t *testing.T) {
+	m := NewCounter("10s1s", "30s5s")
+	m.Add(5)
+	if s := m.String(); s != `5` {
+		t.Fatal(s)
+	}
+}
+
+func TestSubSecondFrames(t *testing.T) {
+	ms := func(n int) func() time.Time {
+		return func() time.Time { return mockTime(0)().Add(time.Duration(n) * time.Millisecond) }
+	}
+	for _, test := range []struct {
+		Frame    string
+		Interval float64
+		Adds     []int
+		Counts   []float64
+	}{
+		{"2s500ms", 0.5, []int{0, 200, 600, 1100, 1400}, []float64{1, 1, 1, 2}},
+		{"1s250ms", 0.25, []int{0, 100, 300, 600, 700}, []float64{1, 1, 1, 2}},
+	} {
+		now = ms(0)
+		c := NewCounter(test.Frame)
+		for _, n := range test.Adds {
+			now = ms(n)
+			c.Add(1)
+		}
+		var v struct {
+			Interval float64
+			Samples  []struct{ Count float64 }
+		}
+		b, _ := json.Marshal(c)
+		json.Unmarshal(b, &v)
+		counts := []float64{}
+		for _, s := range v.Samples {
+			counts = append(counts, s.Count)
+		}
+		if v.Interval != test.Interval || !reflect.DeepEqual(counts, test.Counts) {
+			t.Fatal(test.Frame, string(b))
+		}
+	}
+}
+
+func TestValidateFrames(t *testing.T) {
+	if err := ValidateFrames("60s1s", "15m10s", "2s500ms", "1y1M", "15m"); err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []string{"garbage", "", "1m", "10x1s", "0s1s", "10s1s1s", "1s1m", "1m1m", "90s1m"} {
+		err := ValidateFrames("60s1s", frame)
+		if err == nil || !strings.Contains(err.Error(), strconv.Quote(frame)) {
+			t.Fatal(frame, err)
+		}
+		for _, constructor := range []func(...string) (Metric, error){NewCounterE, NewGaugeE, NewHistogramE} {
+			if m, err := constructor("60s1s", frame); m != nil || err == nil || !strings.Contains(err.Error(), strconv.Quote(frame)) {
+				t.Fatal(frame, m, err)
+			}
+		}
+	}
+	// Validation agrees with the constructors on the default interval
+	c, err := NewCounterE("15m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := c.(*timeseries); ts.interval != time.Minute || len(ts.samples) != 15 {
+		t.Fatal(ts.interval, len(ts.samples))
+	}
+	if _, err := NewHistogramE(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShortFrame(t *testing.T) {
+	var b strings.Builder
+	Logger = log.New(&b, "", 0)
+	defer func() { Logger = log.New(os.Stderr, "metric: ", log.LstdFlags) }()
+	now = mockTime(0)
+	c := NewCounter("1s1m")
+	if s := b.String(); !strings.Contains(s, `"1s1m"`) {
+		t.Fatal(s)
+	}
+	b.Reset()
+	NewCounter("2s1s", "10s1s")
+	if s := b.String(); s != "" {
+		t.Fatal(s)
+	}
+	c.Add(1)
+	c.Add(2)
+	assertJSON(t, c, h{"interval": 60, "total": h{"type": "c", "count": 3}, "samples": v{h{"type": "c", "count": 3}}})
+}
+
+func TestOldestFirst(t *testing.T) {
+	at := func(ms int) func() time.Time {
+		return func() time.Time { return time.Date(2017, 8, 11, 9, 0, 0, ms*int(time.Millisecond), time.UTC) }
+	}
+	now = at(200)
+	c := NewCounter("3s1s")
+	c.Add(1)
+	now = at(1200)
+	c.Add(2)
+	OldestFirst = true
+	defer func() { OldestFirst = false }()
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 3}, "partial": 1,
+		"samples": v{h{"type": "c", "count": 0}, h{"type": "c", "count": 1}, h{"type": "c", "count": 2}}})
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	now = mockTime(0)
+	c, hist := NewCounter("10s1s"), NewHistogram("10s1s")
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 1000; j++ {
+				c.Add(1)
+				hist.Add(float64(j))
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if s := c.String(); s != "8000" {
+		t.Fatal(s)
+	}
+	if total := Peek(hist)[0].(*histogram).total; total != 8000 {
+		t.Fatal(total)
+	}
+}
+
+func TestTotalFunc(t *testing.T) {
+	now = mockTime(0)
+	g := NewGauge("3s1s")
+	g.Add(10)
+	g.Add(2)
+	now = mockTime(1)
+	g.Add(4)
+	peak := func(samples []Metric) float64 {
+		peak := 0.0
+		for _, s := range samples {
+			var gj GaugeJSON
+			b, _ := json.Marshal(s)
+			json.Unmarshal(b, &gj)
+			peak = math.Max(peak, gj.Max)
+		}
+		return peak
+	}
+	TotalFunc(g, peak)
+	assertJSON(t, g, h{"interval": 1,
+		"total": h{"type": "g", "value": 10, "mean": 10, "min": 10, "max": 10},
+		"samples": v{
+			h{"type": "g", "value": 4, "mean": 4, "min": 4, "max": 4},
+			h{"type": "g", "value": 2, "mean": 6, "min": 2, "max": 10},
+			h{"type": "g", "value": 0, "mean": 0, "min": 0, "max": 0},
+		}})
+	if s := g.String(); s != "10" {
+		t.Fatal(s)
+	}
+	TotalFunc(g, nil)
+	assertJSON(t, g.(*timeseries).total, h{"type": "g", "value": 4, "mean": 5.333333333333333, "min": 2, "max": 10})
+}
+
+func TestOnRoll(t *testing.T) {
+	now = mockTime(0)
+	c := NewCounter("10s1s")
+	c.Add(1)
+	rolls := []int{}
+	OnRoll(c, func(rolled int, at time.Time) {
+		rolls = append(rolls, rolled)
+		if !at.Equal(now()) {
+			t.Fatal(at)
+		}
+	})
+	now = mockTime(1)
+	c.Add(1)
+	c.Add(1)
+	now = mockTime(4)
+	_ = c.String()
+	OnRoll(c, nil)
+	now = mockTime(5)
+	c.Add(1)
+	if !reflect.DeepEqual(rolls, []int{1, 3}) {
+		t.Fatal(rolls)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	now = mockTime(0)
+	c := NewCounter("3s1s")
+	c.Add(1)
+	now = mockTime(1)
+	c.Add(2)
+	now = mockTime(10)
+	if samples := Peek(c); len(samples) != 3 || samples[0].String() != "2" || samples[1].String() != "1" {
+		t.Fatal(samples)
+	}
+	// Peeking did not roll the timeline, reading it does
+	if s := c.String(); s != "0" {
+		t.Fatal(s)
+	}
+	if samples := Peek(c); samples[0].String() != "0" || samples[1].String() != "0" {
+		t.Fatal(samples)
+	}
+	if samples := Peek(NewGauge()); len(samples) != 1 {
+		t.Fatal(samples)
+	}
+}
+
+func TestIntegral(t *testing.T) {
+	now = mockTime(0)
+	g := NewGauge("5s2s", "10s2s")
+	g.Add(100)
+	g.Add(200)
+	now = mockTime(2)
+	g.Add(50)
+	if n := Integral(g); n != 400 {
+		t.Fatal(n)
+	}
+	if n := Integral(NewMeanGauge("10s1s")); n != 0 {
+		t.Fatal(n)
+	}
+	if n := Integral(NewCounter("10s1s")); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestResample(t *testing.T) {
+	now = mockTime(0)
+	c, hist := NewCounter("10s1s"), NewHistogram("10s1s")
+	// Samples are centered around the multiples of the interval, so the
+	// samples of 3s..7s fall into the 5s one and the samples of 8s..12s into
+	// the 10s one
+	for i := 0; i < 10; i++ {
+		now = mockTime(i + 3)
+		c.Add(float64(i))
+		hist.Add(float64(i))
+	}
+	if err := Resample(c, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, c, h{"interval": 5, "total": h{"type": "c", "count": 45}, "samples": v{
+		h{"type": "c", "count": 35}, h{"type": "c", "count": 10},
+	}})
+	if err := Resample(hist, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var tl struct{ Samples []HistogramJSON }
+	b, _ := json.Marshal(hist)
+	json.Unmarshal(b, &tl)
+	if len(tl.Samples) != 2 || tl.Samples[0].Min != 5 || tl.Samples[0].Max != 9 || tl.Samples[1].P50 != 2 {
+		t.Fatal(string(b))
+	}
+	// New values land in the new coarser samples
+	now = mockTime(13)
+	c.Add(1)
+	now = mockTime(14)
+	c.Add(1)
+	assertJSON(t, c, h{"interval": 5, "total": h{"type": "c", "count": 37}, "samples": v{
+		h{"type": "c", "count": 2}, h{"type": "c", "count": 35},
+	}})
+
+	for _, test := range []struct {
+		M        Metric
+		Interval time.Duration
+	}{
+		{NewCounter("10s2s"), 3 * time.Second},
+		{NewCounter("10s2s"), time.Second},
+		{NewCounter(), 5 * time.Second},
+		{NewCounter("10s1s", "1m10s"), 5 * time.Second},
+		{NewPSquare(0.5, "10s1s"), 5 * time.Second},
+	} {
+		if err := Resample(test.M, test.Interval); err == nil {
+			t.Fatal(test)
+		}
+	}
+}
+
+func TestAutoReset(t *testing.T) {
+	now = mockTime(0)
+	c := AutoReset(NewCounter(), 10*time.Second)
+	c.Add(1)
+	c.Add(2)
+	assertJSON(t, c, h{"type": "c", "count": 3})
+	now = mockTime(9)
+	assertJSON(t, c, h{"type": "c", "count": 3})
+	now = mockTime(10)
+	assertJSON(t, c, h{"type": "c", "count": 0})
+	c.Add(5)
+	now = mockTime(15)
+	if s := c.String(); s != "5" {
+		t.Fatal(s)
+	}
+
+	tl := AutoReset(NewCounter("3s1s"), 10*time.Second)
+	tl.Add(1)
+	now = mockTime(20)
+	tl.Add(2)
+	if s := tl.String(); s != "2" {
+		t.Fatal(s)
+	}
+}
+
+func TestScaled(t *testing.T) {
+	g := Scaled(NewGauge(), 1e-3)
+	g.Add(2000)
+	g.Add(4000)
+	assertJSON(t, g, h{"type": "g", "value": 4, "mean": 3, "min": 2, "max": 4})
+	if s := g.String(); s != "4" {
+		t.Fatal(s)
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	now = mockTime(0)
+	c := OmitEmpty(NewCounter("3s1s"))
+	c.Add(2)
+	assertJSON(t, c, h{"interval": 1, "total": h{"type": "c", "count": 2},
+		"samples": v{h{"type": "c", "count": 2}, h{"type": "c"}, h{"type": "c"}}})
+	g := OmitEmpty(NewGauge())
+	g.Add(-1)
+	g.Add(1)
+	assertJSON(t, g, h{"type": "g", "value": 1, "min": -1, "max": 1})
+}
+
+func TestRenameKeys(t *testing.T) {
+	now = mockTime(0)
+	hist := RenameKeys(NewHistogram("2s1s"), map[string]string{"p50": "50th", "samples": "points"})
+	hist.Add(1)
+	assertJSON(t, hist, h{"interval": 1,
+		"total": h{"type": "h", "50th": 1, "p90": 1, "p99": 1, "min": 1, "max": 1, "mean": 1},
+		"points": v{
+			h{"type": "h", "50th": 1, "p90": 1, "p99": 1, "min": 1, "max": 1, "mean": 1},
+			h{"type": "h", "50th": 0, "p90": 0, "p99": 0, "min": 0, "max": 0, "mean": 0},
+		}})
+	g := RenameKeys(NewGauge(), map[string]string{"mean": "avg"})
+	g.Add(2)
+	assertJSON(t, g, h{"type": "g", "value": 2, "avg": 2, "min": 2, "max": 2})
+	if s := g.String(); s != "2" {
+		t.Fatal(s)
+	}
+}
+
+func TestPausable(t *testing.T) {
+	c := NewPausable(NewCounter())
+	c.Add(1)
+	c.Pause()
+	if !c.Paused() {
+		t.Fatal("not paused")
+	}
+	c.Add(10)
+	assertJSON(t, c, h{"type": "c", "count": 1})
+	c.Resume()
+	c.Add(2)
+	assertJSON(t, c, h{"type": "c", "count": 3})
+	if s := c.String(); s != "3" {
+		t.Fatal(s)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	now = mockTime(0)
+	c := NewCounter("15s5s", "3s1s")
+	c.Add(1)
+	now = mockTime(12)
+	c.Add(2)
+	points := Series(c)
+	// Samples start half an interval before the times they are centered around
+	at := func(ms int) time.Time { return mockTime(0)().Add(time.Duration(ms) * time.Millisecond) }
+	expect := []Point{{at(-2500), 1}, {at(2500), 0}, {at(9500), 0}, {at(10500), 0}, {at(11500), 2}}
+	if !reflect.DeepEqual(points, expect) {
+		t.Fatal(points)
+	}
+	if points := Series(NewCounter()); len(points) != 0 {
+		t.Fatal(points)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	ts := func(ms int) string {
+		return mockTime(0)().Add(time.Duration(ms) * time.Millisecond).Format(time.RFC3339Nano)
+	}
+	now = mockTime(0)
+	c := NewCounter("3s1s")
+	c.Add(1)
+	now = mockTime(2)
+	c.Add(2)
+	c.Add(2)
+	var b strings.Builder
+	if err := WriteCSV(&b, c); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != "time,value\n"+ts(-500)+",1\n"+ts(500)+",0\n"+ts(1500)+",4\n" {
+		t.Fatal(s)
+	}
+
+	hist := NewHistogram()
+	for i := 1; i <= 3; i++ {
+		hist.Add(float64(i))
+	}
+	b.Reset()
+	if err := WriteCSV(&b, hist); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != "time,p50,p90,p99\n"+ts(2000)+",2,3,3\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	m := NewCounter("2m1s", "15m30s", "1h1m")
+	mm := m.(multimetric)
+	for _, test := range []struct {
+		D      time.Duration
+		Expect *timeseries
+	}{
+		{time.Minute, mm[0]},
+		{2 * time.Minute, mm[0]},
+		{10 * time.Minute, mm[1]},
+		{time.Hour, mm[2]},
+		{24 * time.Hour, mm[2]},
+	} {
+		if w := Window(m, test.D); w != test.Expect {
+			t.Fatal(test.D, w)
+		}
+	}
+	c := NewCounter("10s1s")
+	if w := Window(c, time.Hour); w != c {
+		t.Fatal(w)
+	}
+}
+
+func TestSelfStats(t *testing.T) {
+	c := NewCounter("10s1s")
+	c.Add(1)
+	if n := self.total; n != 0 {
+		t.Fatal(n)
+	}
+	SelfMetrics = true
+	defer func() { SelfMetrics = false }()
+	c.Add(1)
+	NewHistogram("10s1s", "1m10s").Add(1)
+	if n := self.total; n != 2 {
+		t.Fatal(n)
+	}
+	if _, ok := SelfStats().(Histogram); !ok {
+		t.Fatal(SelfStats())
+	}
+}
+
+func TestExpVar(t *testing.T) {
+	expvar.Publish("test:count", NewCounter())
+	expvar.Publish("test:timeline", NewGauge("3s1s"))
+	expvar.Get("test:count").(Metric).Add(1)
+	expvar.Get("test:timeline").(Metric).Add(1)
+	if s := expvar.Get("test:count").String(); s != `1` {
+		t.Fatal(s)
+	}
+	if s := expvar.Get("test:timeline").String(); s != `1` {
+		t.Fatal(s)
+	}
+}
+
+func TestMustPublish(t *testing.T) {
+	c := MustPublish("test:mustpublish", NewCounter())
+	c.Add(3)
+	if s := expvar.Get("test:mustpublish").String(); s != `3` {
+		t.Fatal(s)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate name")
+		}
+	}()
+	MustPublish("test:mustpublish", NewCounter())
+}
+
+func TestGetOrPublish(t *testing.T) {
+	built := 0
+	build := func() Metric {
+		built++
+		return NewCounter()
+	}
+	m1 := GetOrPublish("test:getorpublish", build)
+	m2 := GetOrPublish("test:getorpublish", build)
+	if m1 != m2 || built != 1 || expvar.Get("test:getorpublish") != m1 {
+		t.Fatal(m1, m2, built)
+	}
+}
+
+func TestResetAll(t *testing.T) {
+	c := MustPublish("test:resetall:counter", NewCounter("10s1s"))
+	g := MustPublish("test:resetall:gauge", Scaled(NewGauge(), 2))
+	c.Add(3)
+	g.Add(5)
+	ResetAll()
+	if s := c.String(); s != "0" {
+		t.Fatal(s)
+	}
+	assertJSON(t, g, h{"type": "g", "value": 0, "mean": 0, "min": 0, "max": 0})
+
+	r := NewRegistry()
+	hist := r.Publish("hist", OmitEmpty(NewHistogram()))
+	hist.Add(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hist.Add(1)
+				r.ResetAll()
+			}
+		}()
+	}
+	wg.Wait()
+	r.ResetAll()
+	assertJSON(t, hist, h{"type": "h"})
+}
+
+func TestSnapshotAll(t *testing.T) {
+	now = mockTime(0)
+	reqs := MustPublish("test:snapshot:requests", NewCounter("3s1s"))
+	errs := MustPublish("test:snapshot:errors", NewCounter())
+	reqs.Add(10)
+	errs.Add(2)
+	snap := SnapshotAll("test:snapshot:requests", "test:snapshot:errors", "test:snapshot:missing")
+	if len(snap) != 2 {
+		t.Fatal(snap)
 	}
-	assertJSON(t, hist, h{"type": "h", "p50": 50, "p90": 90, "p99": 99})
+	reqs.Add(10)
+	errs.Add(1)
+	snap["test:snapshot:errors"].Add(5)
+	if r, e := snap["test:snapshot:requests"].String(), snap["test:snapshot:errors"].String(); r != "10" || e != "2" {
+		t.Fatal(r, e)
+	}
+	now = mockTime(10)
+	assertJSON(t, snap["test:snapshot:requests"], h{"interval": 1, "total": h{"type": "c", "count": 10}, "samples": v{
+		h{"type": "c", "count": 10}, h{"type": "c", "count": 0}, h{"type": "c", "count": 0},
+	}})
 }
 
-func TestHistogramNormalDist(t *testing.T) {
-	hist := NewHistogram()
-	rand.Seed(time.Now().UnixNano())
-	for i := 0; i < 10000; i++ {
-		hist.Add(rand.Float64() * 10)
+// racyCounter adds to itself after marshaling, like a concurrent Add.
+type racyCounter struct {
+	*counter
+	adds int
+}
+
+func (c *racyCounter) MarshalJSON() ([]byte, error) {
+	b, err := c.counter.MarshalJSON()
+	if c.adds > 0 {
+		c.adds--
+		c.counter.Add(1)
 	}
-	b, _ := json.Marshal(hist)
-	p := h{}
-	json.Unmarshal(b, &p)
-	if math.Abs(p["p50"].(float64)-5) > 0.5 {
-		t.Fatal(p["p50"])
+	return b, err
+}
+
+func TestWrappers(t *testing.T) {
+	c := &counter{}
+	m := AutoReset(OmitEmpty(Scaled(NewPausable(RenameKeys(RateUnit(c, time.Second), nil)), 2)), time.Hour)
+	if used(m) {
+		t.Fatal("unused metric reported as used")
 	}
-	if math.Abs(p["p90"].(float64)-9) > 0.5 {
-		t.Fatal(p["p90"])
+	m.Add(1)
+	if v, ok := versionOf(m); !ok || v != c.version() || !used(m) {
+		t.Fatal(v, ok)
 	}
-	if math.Abs(p["p99"].(float64)-10) > 0.5 {
-		t.Fatal(p["p99"])
+	if b, err := DebugJSON(m); err != nil || !strings.HasPrefix(string(b), `{"count":2,`) {
+		t.Fatal(string(b), err)
+	}
+	resetMetric(m)
+	if c.value() != 0 {
+		t.Fatal(c.value())
 	}
 }
 
-func TestMetricReset(t *testing.T) {
-	c := &counter{}
-	c.Add(5)
-	assertJSON(t, c, h{"type": "c", "count": 5})
-	c.Reset()
-	assertJSON(t, c, h{"type": "c", "count": 0})
+func TestFreezeConsistent(t *testing.T) {
+	f := Freeze(&racyCounter{&counter{}, 2})
+	assertJSON(t, f, h{"type": "c", "count": 2})
+	if s := f.String(); s != "2" {
+		t.Fatal(s)
+	}
+}
 
-	g := &gauge{}
-	g.Add(5)
-	assertJSON(t, g, h{"type": "g", "mean": 5, "min": 5, "max": 5, "value": 5})
-	g.Reset()
-	assertJSON(t, g, h{"type": "g", "mean": 0, "min": 0, "max": 0, "value": 0})
+func TestInstrument(t *testing.T) {
+	handler := Instrument("test:instrument", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	for _, path := range []string{"/", "/", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	for name, count := range map[string]string{"count": "3", "2xx": "2", "4xx": "1"} {
+		if s := expvar.Get("test:instrument:" + name).String(); s != count {
+			t.Fatal(name, s)
+		}
+	}
+	assertJSON(t, expvar.Get("test:instrument:inflight"), h{"type": "g", "value": 0, "mean": 0.5, "min": 0, "max": 1})
+	if expvar.Get("test:instrument:latency") == nil {
+		t.Fatal("latency not published")
+	}
+	// Panics are counted as server errors
+	panicky := Instrument("test:instrument:panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Fatal(p)
+			}
+		}()
+		panicky.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if v := expvar.Get("test:instrument:panic:5xx"); v == nil || v.String() != "1" || expvar.Get("test:instrument:panic:2xx") != nil {
+		t.Fatal(v)
+	}
+	flushed := httptest.NewRecorder()
+	Instrument("test:instrument:flush", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			t.Error("recorder can't be hijacked")
+		}
+		if w.(interface{ Unwrap() http.ResponseWriter }).Unwrap() != flushed {
+			t.Error("unexpected underlying writer")
+		}
+	})).ServeHTTP(flushed, httptest.NewRequest("GET", "/", nil))
+	if !flushed.Flushed {
+		t.Fatal("not flushed")
+	}
+}
 
-	hist := &histogram{}
-	hist.Add(5)
-	assertJSON(t, hist, h{"type": "h", "p50": 5, "p90": 5, "p99": 5})
-	hist.Reset()
-	assertJSON(t, hist, h{"type": "h", "p50": 0, "p90": 0, "p99": 0})
+func TestLimitedJSONHandler(t *testing.T) {
+	metrics := map[string]Metric{"a": NewCounter(), "b": NewCounter(), "c": NewGauge()}
+	get := func(max int) string {
+		w := httptest.NewRecorder()
+		LimitedJSONHandler(func() map[string]Metric { return metrics }, max).
+			ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if !json.Valid(w.Body.Bytes()) || w.Body.Len() > max {
+			t.Fatal(max, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	if s := get(1000); s != `{"a":{"type":"c","count":0},"b":{"type":"c","count":0},`+
+		`"c":{"type":"g","value":0,"mean":0,"min":0,"max":0}}` {
+		t.Fatal(s)
+	}
+	if s := get(80); s != `{"a":{"type":"c","count":0},"b":{"type":"c","count":0},"_truncated":true}` {
+		t.Fatal(s)
+	}
+	if s := get(20); s != `{"_truncated":true}` {
+		t.Fatal(s)
+	}
+	// Metrics that fail to marshal are skipped
+	broken := NewGauge()
+	broken.Add(math.NaN())
+	metrics["b"] = broken
+	if s := get(1000); s != `{"a":{"type":"c","count":0},`+
+		`"c":{"type":"g","value":0,"mean":0,"min":0,"max":0}}` {
+		t.Fatal(s)
+	}
 }
 
-func TestMetricString(t *testing.T) {
-	c := NewCounter()
-	c.Add(1)
+func TestDebugJSON(t *testing.T) {
+	now = mockTime(0)
+	hist := NewHistogram("2s1s")
+	hist.Add(1)
+	hist.Add(1)
+	hist.Add(3)
+	var state struct {
+		Now     time.Time
+		Samples []struct {
+			Bins  []Bin
+			Total float64
+		}
+	}
+	b, _ := DebugJSON(hist)
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Now.Equal(mockTime(0)()) || len(state.Samples) != 2 || state.Samples[0].Total != 3 ||
+		!reflect.DeepEqual(state.Samples[0].Bins, []Bin{{1, 2}, {3, 1}}) {
+		t.Fatal(string(b))
+	}
+
+	w := httptest.NewRecorder()
+	JSONHandler(func() map[string]Metric { return map[string]Metric{"g": OmitEmpty(NewMeanGauge())} }).
+		ServeHTTP(w, httptest.NewRequest("GET", "/?debug=1", nil))
+	if s := w.Body.String(); s != `{"g":{"sum":0,"count":0,"version":0}}`+"\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Publish("b", NewCounter())
+	r.Publish("a", NewGauge())
+	if r.Get("b") != c || r.Get("c") != nil {
+		t.Fatal(r.Get("b"), r.Get("c"))
+	}
+	names := []string{}
+	r.Each(func(name string, m Metric) {
+		names = append(names, name)
+		// Registering during iteration must not deadlock
+		r.Publish(name+"!", NewCounter())
+	})
+	if !reflect.DeepEqual(names, []string{"a", "b"}) || len(r.Snapshot()) != 4 {
+		t.Fatal(names, r.Snapshot())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("duplicate name did not panic")
+			}
+		}()
+		r.Publish("a", NewCounter())
+	}()
+}
+
+func TestRegistryWithoutExpvar(t *testing.T) {
+	r := NewRegistry()
+	api := r.Namespace("standalone")
+	c := api.Counter("requests")
+	if api.Counter("requests") != c || r.Get("standalone.requests") != c {
+		t.Fatal(r.Snapshot())
+	}
+	h := r.Instrument("standalone", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	for _, name := range []string{"standalone.requests", "standalone:count", "standalone:2xx"} {
+		if r.Get(name) == nil || expvar.Get(name) != nil {
+			t.Fatal(name)
+		}
+	}
+	w := httptest.NewRecorder()
+	JSONHandler(r.Snapshot).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `"standalone:count":{"type":"c","count":1}`) {
+		t.Fatal(w.Body.String())
+	}
+}
+
+func TestRegistryUnregister(t *testing.T) {
+	r := NewRegistry()
+	r.Publish("conn:1", NewCounter())
+	r.Publish("conn:2", NewCounter())
+	handler := JSONHandler(r.Snapshot)
+	get := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+	if s := get(); !strings.Contains(s, "conn:1") {
+		t.Fatal(s)
+	}
+	r.Unregister("conn:1")
+	r.Unregister("conn:404")
+	if s := get(); strings.Contains(s, "conn:1") || !strings.Contains(s, "conn:2") {
+		t.Fatal(s)
+	}
+	r.Publish("conn:1", NewGauge())
+	if _, ok := r.Get("conn:1").(*gauge); !ok {
+		t.Fatal(r.Get("conn:1"))
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	r := NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			r.Publish(strconv.Itoa(i), NewCounter())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if n := len(r.Snapshot()); n != 1000 {
+				t.Fatal(n)
+			}
+			return
+		default:
+			r.Each(func(name string, m Metric) { m.Add(1) })
+		}
+	}
+}
+
+func TestInflux(t *testing.T) {
+	now = mockTime(0)
+	c, hist := NewCounter("10s1s"), NewHistogram()
 	c.Add(3)
-	if s := c.String(); s != "4" {
+	hist.Add(2)
+	metrics := map[string]Metric{"req count": c, "lat": hist, "top": NewTopK(1)}
+	var b strings.Builder
+	WriteInflux(&b, metrics, map[string]string{"host": "a,b"}, now())
+	expect := `lat,host=a\,b max=2,mean=2,min=2,p50=2,p90=2,p99=2 1502442000000000000
+req\ count,host=a\,b count=3 1502442000000000000
+`
+	if s := b.String(); s != expect {
 		t.Fatal(s)
 	}
 
-	g := NewGauge()
-	g.Add(1)
-	g.Add(3)
-	if s := g.String(); s != "3" {
+	body := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body <- r.URL.RawQuery + "\n" + string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	in, err := NewInflux(srv.URL+"/write?db=test", func() map[string]Metric { return metrics },
+		InfluxOptions{Interval: time.Hour, Tags: map[string]string{"host": "a,b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := in.Flush(); err != nil || in.Err() != nil {
+		t.Fatal(err)
+	}
+	if s := <-body; s != "db=test\n"+expect {
 		t.Fatal(s)
 	}
 
-	hist := NewHistogram()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udp, _ := NewInflux("udp://"+conn.LocalAddr().String(), func() map[string]Metric { return metrics },
+		InfluxOptions{Interval: time.Hour, Tags: map[string]string{"host": "a,b"}})
+	defer udp.Close()
+	if err := udp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxPacket)
+	n, _, _ := conn.ReadFrom(buf)
+	if s := string(buf[:n]); s != expect {
+		t.Fatal(s)
+	}
+
+	if _, err := NewInflux("tcp://localhost:8086", nil, InfluxOptions{}); err == nil {
+		t.Fatal("unsupported scheme accepted")
+	}
+
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	timed, _ := NewInflux(slow.URL+"/write?db=test", func() map[string]Metric { return metrics },
+		InfluxOptions{Interval: time.Hour, Timeout: 50 * time.Millisecond})
+	if err := timed.Flush(); err == nil || timed.Err() == nil {
+		t.Fatal("hung push succeeded")
+	}
+	stuck, _ := NewInflux(slow.URL+"/write?db=test", func() map[string]Metric { return metrics },
+		InfluxOptions{Interval: 10 * time.Millisecond, Timeout: time.Hour})
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		stuck.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on a hung push")
+	}
+	if err := timed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := timed.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	api := Namespace("test:ns")
+	c := api.Counter("requests", "10s1s")
+	c.Add(1)
+	if api.Counter("requests") != c || expvar.Get("test:ns.requests") != c {
+		t.Fatal(expvar.Get("test:ns.requests"))
+	}
+	g := api.Namespace("v1").Gauge("queue")
+	if expvar.Get("test:ns.v1.queue") != g {
+		t.Fatal(expvar.Get("test:ns.v1.queue"))
+	}
+	if _, ok := api.Histogram("latency").(*histogram); !ok {
+		t.Fatal(expvar.Get("test:ns.latency"))
+	}
+}
+
+func TestResult(t *testing.T) {
+	ok, fail := NewCounter(), NewCounter()
+	done := Result(ok, fail)
+	done(nil)
+	done(io.EOF)
+	done(nil)
+	if ok.String() != "2" || fail.String() != "1" {
+		t.Fatal(ok, fail)
+	}
+}
+
+func TestMux(t *testing.T) {
+	now = mockTime(0)
+	c, g, hist := NewCounter(), NewGauge("10s1s", "1m10s"), NewHistogram("10s1s")
+	c.Add(3)
+	g.Add(2)
 	hist.Add(1)
-	hist.Add(3)
-	if s := hist.String(); s != `{"p50":1,"p90":3,"p99":3}` {
+	mux := Mux(func() map[string]Metric {
+		return map[string]Metric{"count": c, "gauge": g, "hist": hist, "mean": NewMeanGauge("10s1s")}
+	})
+	get := func(path, accept string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal(path, w.Code)
+		}
+		if vary := w.Header().Get("Vary"); path == "/debug/metrics" && vary != "Accept" {
+			t.Fatal(path, vary)
+		}
+		return w.Body.String()
+	}
+	if s := get("/debug/metrics", "text/html"); !strings.Contains(s, "<h2 class=\"col-1\">hist</h2>") {
+		t.Fatal(s)
+	}
+	js := h{}
+	if err := json.Unmarshal([]byte(get("/debug/metrics", "application/json")), &js); err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, js["count"], h{"type": "c", "count": 3})
+	if s := get("/metrics", ""); s != `# TYPE count counter
+count 3
+# TYPE gauge gauge
+gauge 2
+# TYPE gauge_mean gauge
+gauge_mean 2
+# TYPE gauge_min gauge
+gauge_min 2
+# TYPE gauge_max gauge
+gauge_max 2
+# TYPE hist summary
+hist{quantile="0.5"} 1
+hist{quantile="0.9"} 1
+hist{quantile="0.99"} 1
+# TYPE mean gauge
+mean 0
+` {
 		t.Fatal(s)
 	}
 }
 
-func TestCounterTimeline(t *testing.T) {
+func TestConditionalRequests(t *testing.T) {
 	now = mockTime(0)
-	c := NewCounter("3s1s")
-	expect := func(total float64, samples ...float64) h {
-		timeline := v{}
-		for _, s := range samples {
-			timeline = append(timeline, h{"type": "c", "count": s})
+	c, g := NewCounter(), NewGauge("10s1s")
+	metrics := map[string]Metric{"count": c, "gauge": g}
+	handler := JSONHandler(func() map[string]Metric { return metrics })
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
 		}
-		return h{
-			"interval": 1,
-			"total":    h{"type": "c", "count": total},
-			"samples":  timeline,
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	keys := func(w *httptest.ResponseRecorder) []string {
+		m := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &m)
+		names := []string{}
+		for name := range m {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		return names
+	}
+	w := get("")
+	if w.Code != http.StatusOK || !reflect.DeepEqual(keys(w), []string{"count", "gauge"}) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Fatal(w.Code, w.Body.String())
 	}
-	assertJSON(t, c, expect(0, 0, 0, 0))
 	c.Add(1)
-	assertJSON(t, c, expect(1, 1, 0, 0))
+	w = get(etag)
+	if w.Code != http.StatusOK || w.Header().Get("X-Metrics-Delta") != "true" ||
+		!reflect.DeepEqual(keys(w), []string{"count"}) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	etag = w.Header().Get("ETag")
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Rolling a timeline changes it, too
 	now = mockTime(1)
-	assertJSON(t, c, expect(1, 0, 1, 0))
-	c.Add(5)
-	assertJSON(t, c, expect(6, 5, 1, 0))
-	now = mockTime(3)
-	assertJSON(t, c, expect(5, 0, 0, 5))
-	now = mockTime(10)
-	assertJSON(t, c, expect(0, 0, 0, 0))
+	w = get(etag)
+	if !reflect.DeepEqual(keys(w), []string{"gauge"}) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	etag = w.Header().Get("ETag")
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Adding a metric invalidates the tag
+	metrics["hist"] = NewHistogram()
+	if w := get(etag); w.Header().Get("X-Metrics-Delta") != "" || len(keys(w)) != 3 {
+		t.Fatal(w.Code, w.Body.String())
+	}
 }
 
-func TestGaugeTimeline(t *testing.T) {
-	now = mockTime(0)
-	g := NewGauge("3s1s")
-	gauge := func(value, min, max, mean float64) h {
-		return h{"type": "g", "value": value, "min": min, "max": max, "mean": mean}
+func TestVersionOnRead(t *testing.T) {
+	c := NewCounter().(*counter)
+	if c.version() != 0 {
+		t.Fatal(c.version())
 	}
-	expect := func(total h, samples ...h) h {
-		return h{"interval": 1, "total": total, "samples": samples}
+	before := atomic.LoadUint64(&versions)
+	for i := 0; i < 100; i++ {
+		c.Add(1)
+	}
+	if after := atomic.LoadUint64(&versions); after != before {
+		t.Fatal(before, after)
+	}
+	v := c.version()
+	if v == 0 || c.version() != v {
+		t.Fatal(v, c.version())
+	}
+	c.Add(1)
+	if c.version() <= v {
+		t.Fatal(v, c.version())
 	}
-	assertJSON(t, g, expect(gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
-	g.Add(1)
-	assertJSON(t, g, expect(gauge(1, 1, 1, 1), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
-	now = mockTime(1)
-	assertJSON(t, g, expect(gauge(1, 1, 1, 1), gauge(0, 0, 0, 0), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0)))
-	g.Add(5)
-	assertJSON(t, g, expect(gauge(5, 1, 5, 3), gauge(5, 5, 5, 5), gauge(1, 1, 1, 1), gauge(0, 0, 0, 0)))
-	now = mockTime(3)
-	assertJSON(t, g, expect(gauge(5, 5, 5, 5), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(5, 5, 5, 5)))
-	now = mockTime(10)
-	assertJSON(t, g, expect(gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0), gauge(0, 0, 0, 0)))
 }
 
-func TestHistogramTimeline(t *testing.T) {
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	srv, err := ListenUnix(path, func() map[string]Metric { return map[string]Metric{"c": NewCounter()} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if s := string(b); s != "# TYPE c counter\nc 0\n" {
+		t.Fatal(s)
+	}
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestLive(t *testing.T) {
 	now = mockTime(0)
-	hist := NewHistogram("3s1s")
-	histogram := func(p50, p90, p99 float64) h {
-		return h{"type": "h", "p50": p50, "p90": p90, "p99": p99}
+	metrics := map[string]Metric{
+		"c":      NewCounter(),
+		"idle":   NewCounter(),
+		"tl":     NewGauge("10s1s"),
+		"multi":  NewHistogram("10s1s", "1m10s"),
+		"scaled": Scaled(NewGauge("10s1s"), 2),
+		"top":    NewTopK(1),
 	}
-	expect := func(total h, samples ...h) h {
-		return h{"interval": 1, "total": total, "samples": samples}
+	metrics["c"].Add(1)
+	metrics["multi"].Add(1)
+	now = mockTime(20)
+	// Rolls must not count as values
+	json.Marshal(metrics)
+	live := Live(func() map[string]Metric { return metrics })()
+	names := []string{}
+	for name := range live {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"c", "multi", "top"}) {
+		t.Fatal(names)
+	}
+	metrics["scaled"].Add(1)
+	if live := Live(func() map[string]Metric { return metrics })(); live["scaled"] == nil {
+		t.Fatal(live)
 	}
-	assertJSON(t, hist, expect(histogram(0, 0, 0), histogram(0, 0, 0), histogram(0, 0, 0), histogram(0, 0, 0)))
-	hist.Add(1)
-	assertJSON(t, hist, expect(histogram(1, 1, 1), histogram(1, 1, 1), histogram(0, 0, 0), histogram(0, 0, 0)))
-	now = mockTime(1)
-	assertJSON(t, hist, expect(histogram(1, 1, 1), histogram(0, 0, 0), histogram(1, 1, 1), histogram(0, 0, 0)))
-	hist.Add(3)
-	hist.Add(5)
-	assertJSON(t, hist, expect(histogram(3, 5, 5), histogram(3, 5, 5), histogram(1, 1, 1), histogram(0, 0, 0)))
-	now = mockTime(3)
-	assertJSON(t, hist, expect(histogram(3, 5, 5), histogram(0, 0, 0), histogram(0, 0, 0), histogram(3, 5, 5)))
-	now = mockTime(10)
-	assertJSON(t, hist, expect(histogram(0, 0, 0), histogram(0, 0, 0), histogram(0, 0, 0), histogram(0, 0, 0)))
 }
 
-func TestMulti(t *testing.T) {
-	m := NewCounter("10s1s", "30s5s")
-	m.Add(5)
-	if s := m.String(); s != `5` {
+func TestPump(t *testing.T) {
+	c := NewCounter()
+	ch := make(chan float64, 16)
+	stop := Pump(c, ch)
+	for i := 0; i < 10; i++ {
+		ch <- 1
+	}
+	close(ch)
+	stop()
+	if s := c.String(); s != "10" {
 		t.Fatal(s)
 	}
+	stop()
+
+	// Stop ends the pump while the channel is still open
+	g := NewGauge()
+	ch = make(chan float64)
+	stop = Pump(g, ch)
+	ch <- 5
+	stop()
+	select {
+	case ch <- 7:
+		t.Fatal("value received after stop")
+	default:
+	}
+	assertJSON(t, g, h{"type": "g", "value": 5, "mean": 5, "min": 5, "max": 5})
 }
 
-func TestExpVar(t *testing.T) {
-	expvar.Publish("test:count", NewCounter())
-	expvar.Publish("test:timeline", NewGauge("3s1s"))
-	expvar.Get("test:count").(Metric).Add(1)
-	expvar.Get("test:timeline").(Metric).Add(1)
-	if s := expvar.Get("test:count").String(); s != `1` {
-		t.Fatal(s)
+func TestRegisterRuntime(t *testing.T) {
+	runtime.GC()
+	stop := RegisterRuntime(time.Hour, "10s1s")
+	stop()
+	stop()
+	for _, name := range []string{"go:numgoroutine", "go:alloc"} {
+		if x, _ := strconv.ParseFloat(expvar.Get(name).String(), 64); !(x > 0) {
+			t.Fatal(name, x)
+		}
 	}
-	if s := expvar.Get("test:timeline").String(); s != `1` {
-		t.Fatal(s)
+	if m := expvar.Get("go:gcpause").(Metric); !used(m) {
+		t.Fatal(m)
+	}
+	// Metrics are reused when registered again, without adding the same GC
+	// pauses twice
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	pauses := func() float64 {
+		ts := expvar.Get("go:gcpause").(*timeseries)
+		ts.Lock()
+		defer ts.Unlock()
+		h := ts.total.(*histogram)
+		h.Lock()
+		defer h.Unlock()
+		return h.total
+	}
+	before := pauses()
+	RegisterRuntime(time.Hour)()
+	if after := pauses(); after != before {
+		t.Fatal(before, after)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	MustPublish("test:register", NewCounter())
+	Register("/test/register")
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/test/register", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "test:register") {
+		t.Fatal(w.Code, w.Body.String())
 	}
 }
 
@@ -265,4 +2734,34 @@ func BenchmarkMetrics(b *testing.B) {
 			c.Add(rand.Float64())
 		}
 	})
+	b.Run("timeline/histogram/keepbins", func(b *testing.B) {
+		c := NewHistogramWith(HistogramOptions{KeepBins: true}, "10s1s")
+		for i := 0; i < b.N; i++ {
+			c.Add(rand.Float64())
+		}
+	})
+}
+
+// BenchmarkNew reports the memory used by each new metric, e.g. to weigh
+// changes to the metric structs.
+func BenchmarkNew(b *testing.B) {
+	for _, test := range []struct {
+		Name  string
+		Build func() Metric
+	}{
+		{"counter", func() Metric { return NewCounter() }},
+		{"gauge", func() Metric { return NewGauge() }},
+		{"histogram", func() Metric { return NewHistogram() }},
+		{"timeline/counter", func() Metric { return NewCounter("10s1s") }},
+		{"timeline/gauge", func() Metric { return NewGauge("10s1s") }},
+		{"timeline/histogram", func() Metric { return NewHistogram("10s1s") }},
+	} {
+		b.Run(test.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			metrics := make([]Metric, b.N)
+			for i := 0; i < b.N; i++ {
+				metrics[i] = test.Build()
+			}
+		})
+	}
 }
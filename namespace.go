@@ -0,0 +1,39 @@
+package metric
+
+// Group creates metrics published under a common name prefix.
+type Group struct {
+	prefix  string
+	publish func(name string, build func() Metric) Metric
+}
+
+// Namespace returns a group that publishes metrics with names prefixed by
+// the given prefix and a dot, e.g. Namespace("api").Counter("requests") is
+// published as "api.requests". Metrics are published with GetOrPublish, so
+// asking for the same name again returns the existing metric.
+func Namespace(prefix string) *Group {
+	return &Group{prefix: prefix, publish: GetOrPublish}
+}
+
+// Namespace returns a nested group, e.g. Namespace("api").Namespace("v1").
+func (g *Group) Namespace(prefix string) *Group {
+	return &Group{prefix: g.name(prefix), publish: g.publish}
+}
+
+func (g *Group) name(name string) string {
+	return g.prefix + "." + name
+}
+
+// Counter returns a counter published under the prefixed name.
+func (g *Group) Counter(name string, frames ...string) Metric {
+	return g.publish(g.name(name), func() Metric { return NewCounter(frames...) })
+}
+
+// Gauge returns a gauge published under the prefixed name.
+func (g *Group) Gauge(name string, frames ...string) Metric {
+	return g.publish(g.name(name), func() Metric { return NewGauge(frames...) })
+}
+
+// Histogram returns a histogram published under the prefixed name.
+func (g *Group) Histogram(name string, frames ...string) Metric {
+	return g.publish(g.name(name), func() Metric { return NewHistogram(frames...) })
+}
@@ -0,0 +1,195 @@
+package metric
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusHandler returns an http.Handler that exposes all provided metrics
+// in Prometheus text format. Timelines are reported by their totals.
+func PrometheusHandler(snapshot func() map[string]Metric) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w, snapshot())
+	})
+}
+
+// WritePrometheus writes metrics in Prometheus text format. Counters become
+// Prometheus counters, except for timeline counters, whose totals decrease as
+// old samples roll out and thus become gauges. Gauges become gauges (with additional _mean, _min and
+// _max gauges), histograms and P² quantiles become summaries, heatmaps become
+// histograms. Other metric types are exported as a set of untyped values, one
+// per field.
+func WritePrometheus(w io.Writer, metrics map[string]Metric) error {
+	names := []string{}
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	written := map[string]bool{}
+	for _, name := range names {
+		promName := PrometheusName(name)
+		if written[promName] {
+			// Metric families must be unique, the first name wins
+			continue
+		}
+		written[promName] = true
+		b, err := json.Marshal(metrics[name])
+		if err != nil {
+			return err
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		_, timeline := m["total"]
+		if _, ok := m["metrics"]; ok {
+			timeline = true
+		}
+		writePrometheusMetric(bw, promName, current(m), timeline)
+	}
+	return bw.Flush()
+}
+
+// PrometheusName returns the metric name used by WritePrometheus: characters
+// other than ASCII letters, digits and underscores, including colons that are
+// reserved for recording rules, are replaced with underscores, runs of
+// underscores are collapsed, and a leading digit is prefixed with an
+// underscore, e.g. "fib:rec:sec" becomes "fib_rec_sec". If several metrics
+// map to the same name, only the first one in the order of the original
+// names is written.
+func PrometheusName(name string) string {
+	var b strings.Builder
+	last := rune(0)
+	for _, c := range name {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !valid {
+			c = '_'
+		}
+		if c == '_' && last == '_' {
+			continue
+		}
+		if b.Len() == 0 && c >= '0' && c <= '9' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(c)
+		last = c
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// current returns the JSON object describing the current state of a metric,
+// which is a total of the longest timeline for multi-frame metrics.
+func current(m map[string]interface{}) map[string]interface{} {
+	if mm, ok := m["metrics"].([]interface{}); ok && len(mm) > 0 {
+		m, _ = mm[len(mm)-1].(map[string]interface{})
+	}
+	if total, ok := m["total"].(map[string]interface{}); ok {
+		return total
+	}
+	return m
+}
+
+func writePrometheusMetric(w io.Writer, name string, m map[string]interface{}, timeline bool) {
+	num := func(key string) string {
+		f, _ := m[key].(float64)
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	switch m["type"] {
+	case "c":
+		typ := "counter"
+		if timeline {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, typ, name, num("count"))
+	case "g":
+		value := "value"
+		if _, ok := m[value]; !ok {
+			value = "mean"
+		}
+		fmt.Fprintf(w, "# TYPE %s gauge\n%s %s\n", name, name, num(value))
+		for _, k := range []string{"mean", "min", "max"} {
+			if _, ok := m[k]; ok && k != value {
+				fmt.Fprintf(w, "# TYPE %s_%s gauge\n%s_%s %s\n", name, k, name, k, num(k))
+			}
+		}
+	case "h":
+		fmt.Fprintf(w, "# TYPE %s summary\n", name)
+		for _, q := range []struct{ key, quantile string }{{"p50", "0.5"}, {"p90", "0.9"}, {"p99", "0.99"}} {
+			fmt.Fprintf(w, "%s{quantile=\"%s\"} %s\n", name, q.quantile, num(q.key))
+		}
+	case "p2":
+		p, _ := m["p"].(float64)
+		fmt.Fprintf(w, "# TYPE %s summary\n%s{quantile=\"%s\"} %s\n",
+			name, name, strconv.FormatFloat(p, 'g', -1, 64), num("value"))
+	case "hm":
+		bounds, _ := m["bounds"].([]interface{})
+		counts, _ := m["counts"].([]interface{})
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		total := 0.0
+		for i, c := range counts {
+			n, _ := c.(float64)
+			total += n
+			le := "+Inf"
+			if i < len(bounds) {
+				b, _ := bounds[i].(float64)
+				le = strconv.FormatFloat(b, 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %s\n", name, le, strconv.FormatFloat(total, 'g', -1, 64))
+		}
+		fmt.Fprintf(w, "%s_sum %s\n%s_count %s\n", name, num("sum"), name, strconv.FormatFloat(total, 'g', -1, 64))
+	default:
+		keys := []string{}
+		for k, v := range m {
+			if _, ok := v.(float64); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "# TYPE %s_%s untyped\n%s_%s %s\n", name, k, name, k, num(k))
+		}
+	}
+}
+
+// PromBucket is a cumulative Prometheus histogram bucket: the number of
+// observations less than or equal to Le.
+type PromBucket struct {
+	Le    float64
+	Count float64
+}
+
+// AddPromBuckets adds the observations of cumulative Prometheus buckets to the
+// histogram, e.g. when federating from a Prometheus exporter. The counts of
+// each bucket are recorded at the middle of the bucket, assuming that the
+// first bucket starts at zero. Observations of the +Inf bucket are recorded
+// at the largest finite bound.
+func AddPromBuckets(h Histogram, buckets []PromBucket) {
+	if len(buckets) == 0 {
+		return
+	}
+	buckets = append([]PromBucket{}, buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Le < buckets[j].Le })
+	pairs := make([]Bin, 0, len(buckets))
+	lower, count := math.Min(0, buckets[0].Le), 0.0
+	for _, b := range buckets {
+		value := (lower + b.Le) / 2
+		if math.IsInf(b.Le, 1) {
+			value = lower
+		}
+		pairs = append(pairs, Bin{Value: value, Count: b.Count - count})
+		lower, count = b.Le, math.Max(count, b.Count)
+	}
+	h.AddPairs(pairs)
+}
@@ -0,0 +1,137 @@
+package metric
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// NewPSquare returns a metric that estimates a single quantile q (e.g. 0.99)
+// of the incoming numbers with the P² algorithm by Jain and Chlamtac. It keeps
+// only five markers, so memory and update costs are constant regardless of
+// the number of observations. P² estimates can't be merged, so the total of a
+// timeline covers all values added since it was created or last reset. It
+// panics if q is not between 0 and 1.
+func NewPSquare(q float64, frames ...string) Metric {
+	if !(q > 0 && q < 1) {
+		panic("metric: quantile out of range: " + strconv.FormatFloat(q, 'g', -1, 64))
+	}
+	return newMetric(func() metric { return &psquare{p: q} }, frames...)
+}
+
+type psquare struct {
+	sync.Mutex
+	meta
+	p     float64
+	count int
+	q     [5]float64 // marker heights
+	n     [5]float64 // actual marker positions
+	np    [5]float64 // desired marker positions
+}
+
+func (ps *psquare) String() string {
+	ps.Lock()
+	defer ps.Unlock()
+	return strconv.FormatFloat(ps.value(), 'g', -1, 64)
+}
+
+func (ps *psquare) Reset() {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.reset()
+	ps.count = 0
+}
+
+func (ps *psquare) Add(x float64) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.touch()
+	if ps.count < 5 {
+		ps.q[ps.count] = x
+		ps.count++
+		if ps.count == 5 {
+			sort.Float64s(ps.q[:])
+			p := ps.p
+			ps.n = [5]float64{1, 2, 3, 4, 5}
+			ps.np = [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5}
+		}
+		return
+	}
+	ps.count++
+	// Find the cell the value falls into, extending the extreme markers if needed
+	var k int
+	switch {
+	case x < ps.q[0]:
+		ps.q[0], k = x, 0
+	case x < ps.q[1]:
+		k = 0
+	case x < ps.q[2]:
+		k = 1
+	case x < ps.q[3]:
+		k = 2
+	case x <= ps.q[4]:
+		k = 3
+	default:
+		ps.q[4], k = x, 3
+	}
+	for i := k + 1; i < 5; i++ {
+		ps.n[i]++
+	}
+	dn := [5]float64{0, ps.p / 2, ps.p, (1 + ps.p) / 2, 1}
+	for i := range ps.np {
+		ps.np[i] += dn[i]
+	}
+	// Adjust the heights of the middle markers if they are off their positions
+	for i := 1; i < 4; i++ {
+		d := ps.np[i] - ps.n[i]
+		if (d >= 1 && ps.n[i+1]-ps.n[i] > 1) || (d <= -1 && ps.n[i-1]-ps.n[i] < -1) {
+			s := 1.0
+			if d < 0 {
+				s = -1
+			}
+			if q := ps.parabolic(i, s); ps.q[i-1] < q && q < ps.q[i+1] {
+				ps.q[i] = q
+			} else {
+				ps.q[i] = ps.linear(i, s)
+			}
+			ps.n[i] += s
+		}
+	}
+}
+
+func (ps *psquare) parabolic(i int, d float64) float64 {
+	q, n := ps.q, ps.n
+	return q[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+		(n[i+1]-n[i]-d)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (ps *psquare) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return ps.q[i] + d*(ps.q[j]-ps.q[i])/(ps.n[j]-ps.n[i])
+}
+
+// value returns the estimated quantile. Until the markers are initialized it
+// is calculated exactly from the few values seen so far.
+func (ps *psquare) value() float64 {
+	if ps.count >= 5 {
+		return ps.q[2]
+	}
+	values := append([]float64{}, ps.q[:ps.count]...)
+	sort.Float64s(values)
+	return quantileOf(values, ps.p)
+}
+
+func (ps *psquare) MarshalJSON() ([]byte, error) {
+	ps.Lock()
+	defer ps.Unlock()
+	return marshal(struct {
+		Type  string    `json:"type"`
+		P     float64   `json:"p"`
+		Value float64   `json:"value"`
+		Meta  *MetaJSON `json:"_meta,omitempty"`
+	}{"p2", ps.p, ps.value(), ps.meta.meta()})
+}
+
+// Aggregate does nothing, because P² estimates can't be merged. The total
+// keeps receiving all added values instead.
+func (ps *psquare) Aggregate(roll int, samples []metric) {}
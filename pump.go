@@ -0,0 +1,52 @@
+package metric
+
+import "sync"
+
+// Pump adds the values received from the channel to the metric in a separate
+// goroutine until the channel is closed or stop is called, so that producers
+// only send to the channel and never wait for the metric locks:
+//
+//	ch := make(chan float64, 1024)
+//	stop := Pump(latency, ch)
+//	defer stop()
+//	...
+//	ch <- elapsed.Seconds()
+//
+// The channel buffer absorbs bursts of values. Once it is full the senders
+// block until the metric catches up, unless they use a select with a default
+// case to drop values instead. Stop adds the values still buffered and waits
+// for the goroutine to finish, so no values are added after it returns.
+func Pump(m Metric, ch <-chan float64) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-done:
+				// Add the values sent before stop was called
+				for {
+					select {
+					case n, ok := <-ch:
+						if !ok {
+							return
+						}
+						m.Add(n)
+					default:
+						return
+					}
+				}
+			case n, ok := <-ch:
+				if !ok {
+					return
+				}
+				m.Add(n)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
@@ -0,0 +1,100 @@
+package metric
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the time constant of the rate counter average, so that the
+// rate reacts to changes within about a minute.
+const rateWindow = time.Minute
+
+// NewRateCounter returns a counter metric that reports both the cumulative
+// count and the current rate of events per second, like a meter:
+// {"type":"rc","count":...,"rate":...}. The rate is an exponentially weighted
+// moving average with a one minute time constant, updated with the time
+// elapsed between adds, so it fades out when no events arrive. Timeline
+// samples count their own events, but the rate carries over between them.
+func NewRateCounter(frames ...string) Metric {
+	return newMetric(func() metric { return &rateCounter{} }, frames...)
+}
+
+type rateCounter struct {
+	sync.Mutex
+	meta
+	count float64
+	rate  float64
+	at    time.Time
+}
+
+func (c *rateCounter) String() string {
+	c.Lock()
+	defer c.Unlock()
+	return strconv.FormatFloat(c.count, 'g', -1, 64)
+}
+
+// current returns the rate decayed to the given time.
+func (c *rateCounter) current(t time.Time) float64 {
+	if c.at.IsZero() || !t.After(c.at) {
+		return c.rate
+	}
+	return c.rate * math.Exp(-t.Sub(c.at).Seconds()/rateWindow.Seconds())
+}
+
+func (c *rateCounter) Add(n float64) {
+	c.Lock()
+	defer c.Unlock()
+	t := now()
+	c.rate = c.current(t) + n/rateWindow.Seconds()
+	c.at = t
+	c.count = c.count + n
+	c.touch()
+}
+
+// Reset clears the count, but keeps the rate, which fades out by itself.
+func (c *rateCounter) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.reset()
+	c.count = 0
+}
+
+func (c *rateCounter) carry(prev metric) {
+	p := prev.(*rateCounter)
+	p.Lock()
+	rate, at := p.rate, p.at
+	p.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	c.rate, c.at = rate, at
+}
+
+func (c *rateCounter) MarshalJSON() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	return marshal(struct {
+		Type  string    `json:"type"`
+		Count float64   `json:"count"`
+		Rate  float64   `json:"rate"`
+		Meta  *MetaJSON `json:"_meta,omitempty"`
+	}{"rc", c.count, c.current(now()), c.meta.meta()})
+}
+
+// Aggregate sums up the counts and reports the most recent rate.
+func (c *rateCounter) Aggregate(roll int, samples []metric) {
+	c.Lock()
+	defer c.Unlock()
+	c.touch()
+	c.count, c.rate, c.at = 0, 0, time.Time{}
+	for _, s := range samples {
+		s := s.(*rateCounter)
+		s.Lock()
+		c.count = c.count + s.count
+		if s.at.After(c.at) {
+			c.rate, c.at = s.rate, s.at
+		}
+		s.Unlock()
+	}
+}
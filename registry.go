@@ -0,0 +1,108 @@
+package metric
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Registry is a set of named metrics, an alternative to the global expvar
+// registry, e.g. for tests or for exposing separate sets of metrics. Use its
+// Snapshot method with handlers, e.g. Handler(r.Snapshot).
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]Metric
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]Metric{}}
+}
+
+// Publish adds the metric to the registry under the given name and returns
+// the metric itself. Like expvar.Publish, it panics if the name is already
+// registered.
+func (r *Registry) Publish(name string, m Metric) Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metric: reuse of registered name: " + name)
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// GetOrPublish returns the metric registered under the given name, or builds
+// a new one, registers it and returns it, like the package-level GetOrPublish
+// does for expvar.
+func (r *Registry) GetOrPublish(name string, build func() Metric) Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+	m := build()
+	r.metrics[name] = m
+	return m
+}
+
+// Namespace returns a group that registers metrics in the registry with names
+// prefixed by the given prefix and a dot, like the package-level Namespace.
+func (r *Registry) Namespace(prefix string) *Group {
+	return &Group{prefix: prefix, publish: r.GetOrPublish}
+}
+
+// Instrument measures requests served by h like the package-level
+// Instrument, but registers the metrics in the registry.
+func (r *Registry) Instrument(name string, h http.Handler, frames ...string) http.Handler {
+	return instrument(r.GetOrPublish, name, h, frames...)
+}
+
+// Unregister removes the metric registered under the given name, if any, so
+// that it is no longer exposed and can be garbage collected. The name can be
+// registered again afterwards.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.metrics, name)
+}
+
+// Get returns the metric registered under the given name, or nil.
+func (r *Registry) Get(name string) Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metrics[name]
+}
+
+// Snapshot returns a copy of the registered metrics keyed by their names.
+func (r *Registry) Snapshot() map[string]Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := make(map[string]Metric, len(r.metrics))
+	for name, metric := range r.metrics {
+		m[name] = metric
+	}
+	return m
+}
+
+// ResetAll resets all registered metrics, like the package-level ResetAll.
+func (r *Registry) ResetAll() {
+	for _, m := range r.Snapshot() {
+		resetMetric(m)
+	}
+}
+
+// Each calls fn for each registered metric in the order of their names. It
+// iterates over a snapshot taken beforehand, so fn may register new metrics,
+// which are not visited until the next call.
+func (r *Registry) Each(fn func(name string, m Metric)) {
+	metrics := r.Snapshot()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, metrics[name])
+	}
+}
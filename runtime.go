@@ -0,0 +1,68 @@
+package metric
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// numGC is the number of GC cycles whose pauses have been added to
+// go:gcpause, shared by all RegisterRuntime calls.
+var (
+	gcMu  sync.Mutex
+	numGC uint32
+)
+
+// RegisterRuntime publishes metrics of the Go runtime with the given frames
+// and updates them with the given interval until stop is called:
+//
+//	go:numgoroutine - gauge of the number of goroutines
+//	go:numcgocall   - gauge of the number of cgo calls made
+//	go:alloc        - gauge of the allocated heap memory in megabytes
+//	go:allocrate    - derivative of the allocated memory in megabytes/sec
+//	go:gcpause      - duration histogram of the GC pauses in seconds
+//
+// Metrics are published with GetOrPublish, so calling it again reuses them.
+// Each GC pause is added to go:gcpause once, no matter how many times it's
+// registered.
+func RegisterRuntime(interval time.Duration, frames ...string) (stop func()) {
+	goroutines := GetOrPublish("go:numgoroutine", func() Metric { return NewGauge(frames...) })
+	cgocalls := GetOrPublish("go:numcgocall", func() Metric { return NewGauge(frames...) })
+	alloc := GetOrPublish("go:alloc", func() Metric { return Scaled(NewGauge(frames...), 1e-6) })
+	allocrate := GetOrPublish("go:allocrate", func() Metric { return Scaled(NewDerivative(frames...), 1e-6) })
+	gcpause := GetOrPublish("go:gcpause", func() Metric { return NewDurationHistogram(frames...) })
+
+	collect := func() {
+		m := &runtime.MemStats{}
+		runtime.ReadMemStats(m)
+		goroutines.Add(float64(runtime.NumGoroutine()))
+		cgocalls.Add(float64(runtime.NumCgoCall()))
+		alloc.Add(float64(m.Alloc))
+		allocrate.Add(float64(m.TotalAlloc))
+		gcMu.Lock()
+		defer gcMu.Unlock()
+		// PauseNs keeps the pauses of the last 256 collections
+		if m.NumGC-numGC > uint32(len(m.PauseNs)) {
+			numGC = m.NumGC - uint32(len(m.PauseNs))
+		}
+		for ; numGC < m.NumGC; numGC++ {
+			gcpause.Add(float64(m.PauseNs[numGC%uint32(len(m.PauseNs))]) / 1e9)
+		}
+	}
+	collect()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				collect()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package metric
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// SharedCounter is a counter kept in a memory-mapped file, so that several
+// processes, e.g. prefork workers, can increment the same counter and any of
+// them can report the total.
+type SharedCounter struct {
+	data  []byte
+	count *uint64
+}
+
+// NewSharedCounter opens the counter stored in the file at the given path,
+// creating the file if needed. Each process that opens the same file shares
+// the same value, so the file should be removed (or the counter reset) when
+// the server starts. Call Close to unmap the file when done.
+func NewSharedCounter(path string) (*SharedCounter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Truncate(8); err != nil {
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, 8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedCounter{data: data, count: (*uint64)(unsafe.Pointer(&data[0]))}, nil
+}
+
+func (c *SharedCounter) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(c.count))
+}
+
+// Add increments the shared value atomically.
+func (c *SharedCounter) Add(n float64) {
+	for {
+		old := atomic.LoadUint64(c.count)
+		if atomic.CompareAndSwapUint64(c.count, old, math.Float64bits(math.Float64frombits(old)+n)) {
+			return
+		}
+	}
+}
+
+// Reset sets the shared value to zero for all processes.
+func (c *SharedCounter) Reset() {
+	atomic.StoreUint64(c.count, 0)
+}
+
+func (c *SharedCounter) String() string { return strconv.FormatFloat(c.value(), 'g', -1, 64) }
+
+func (c *SharedCounter) MarshalJSON() ([]byte, error) {
+	return marshal(CounterJSON{Type: "c", Count: c.value()})
+}
+
+// Close unmaps the file, the counter must not be used afterwards.
+func (c *SharedCounter) Close() error {
+	return syscall.Munmap(c.data)
+}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package metric
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSharedCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests")
+	// Each counter maps the file separately, like in different processes
+	workers := []*SharedCounter{}
+	for i := 0; i < 4; i++ {
+		c, err := NewSharedCounter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		workers = append(workers, c)
+	}
+	var wg sync.WaitGroup
+	for _, c := range workers {
+		wg.Add(1)
+		go func(c *SharedCounter) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Add(1)
+			}
+		}(c)
+	}
+	wg.Wait()
+	assertJSON(t, workers[0], h{"type": "c", "count": 4000})
+	workers[1].Reset()
+	if s := workers[2].String(); s != "0" {
+		t.Fatal(s)
+	}
+
+	reopened, err := NewSharedCounter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	workers[3].Add(5)
+	if s := reopened.String(); s != "5" {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,95 @@
+package metric
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewSlidingHistogram returns a histogram metric that calculates exact 50%,
+// 90% and 99% percentiles of the values observed within the last window
+// duration. Unlike histogram timelines, which drop the whole oldest sample at
+// once, it expires each observation individually, so percentiles change
+// smoothly. The cost is memory: every observation within the window is kept
+// along with its timestamp, so it only suits metrics with moderate rates.
+func NewSlidingHistogram(window time.Duration) Metric {
+	return &sliding{window: window}
+}
+
+type observation struct {
+	t     time.Time
+	value float64
+}
+
+type sliding struct {
+	sync.Mutex
+	window time.Duration
+	obs    []observation
+}
+
+// expire removes observations older than the window.
+func (s *sliding) expire() {
+	cutoff := now().Add(-s.window)
+	i := sort.Search(len(s.obs), func(i int) bool { return s.obs[i].t.After(cutoff) })
+	if i > 0 {
+		n := copy(s.obs, s.obs[i:])
+		s.obs = s.obs[:n]
+	}
+}
+
+func (s *sliding) Add(n float64) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	s.obs = append(s.obs, observation{t: now(), value: n})
+}
+
+func (s *sliding) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.obs = nil
+}
+
+// sorted returns the observed values in ascending order.
+func (s *sliding) sorted() []float64 {
+	values := make([]float64, len(s.obs))
+	for i, o := range s.obs {
+		values[i] = o.value
+	}
+	sort.Float64s(values)
+	return values
+}
+
+func quantileOf(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (s *sliding) MarshalJSON() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+	values := s.sorted()
+	hj := HistogramJSON{Type: "h",
+		P50: quantileOf(values, 0.5), P90: quantileOf(values, 0.9), P99: quantileOf(values, 0.99)}
+	if len(values) > 0 {
+		hj.Min, hj.Max = values[0], values[len(values)-1]
+		for _, x := range values {
+			hj.Mean += x
+		}
+		hj.Mean /= float64(len(values))
+	}
+	return marshal(hj)
+}
+
+func (s *sliding) String() string {
+	b, _ := s.MarshalJSON()
+	return string(b)
+}
@@ -0,0 +1,93 @@
+package metric
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Aggregator is implemented by custom metrics that can combine timeline
+// samples, see NewTimeline. Aggregate is called on the timeline total each
+// time the timeline rolls, with roll being the number of samples rolled and
+// samples being all samples of the timeline, newest first.
+type Aggregator interface {
+	Aggregate(roll int, samples []Metric)
+}
+
+// NewTimeline returns a timeline of metrics created by the builder, e.g. of a
+// custom Metric implementation or of a metric like TopK that doesn't take
+// frames itself. Only Add is available on the timeline, so e.g. TopK samples
+// track numbers as keys:
+//
+//	codes := NewTimeline(func() Metric { return NewTopK(10) }, "1h1m")
+//	codes.Add(404)
+//
+// Custom metrics don't need to be safe for concurrent use, the timeline
+// serializes the calls. The timeline is marshaled like other timelines. Samples are cleared with
+// their Reset method if they have one, otherwise they are replaced with new
+// metrics from the builder. The total is updated with Aggregate if the metric
+// implements Aggregator, otherwise it receives all values added since the
+// timeline was created or fully reset.
+func NewTimeline(builder func() Metric, frame string) Metric {
+	return newTimeseries(func() metric {
+		m := builder()
+		if m, ok := m.(metric); ok {
+			return m
+		}
+		return &custom{Metric: m, builder: builder}
+	}, frame)
+}
+
+// custom adapts a user-defined Metric to be used as a timeline sample.
+type custom struct {
+	sync.Mutex
+	meta
+	Metric
+	builder func() Metric
+}
+
+func (c *custom) Add(n float64) {
+	c.Lock()
+	defer c.Unlock()
+	c.Metric.Add(n)
+	c.touch()
+}
+
+func (c *custom) String() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.Metric.String()
+}
+
+func (c *custom) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.reset()
+	if r, ok := c.Metric.(interface{ Reset() }); ok {
+		r.Reset()
+	} else {
+		c.Metric = c.builder()
+	}
+}
+
+// Aggregate passes the samples to the custom metric. Samples are not locked,
+// since the timeline doesn't add to them while it rolls.
+func (c *custom) Aggregate(roll int, samples []metric) {
+	c.Lock()
+	defer c.Unlock()
+	a, ok := c.Metric.(Aggregator)
+	if !ok {
+		return
+	}
+	c.touch()
+	ms := make([]Metric, len(samples))
+	for i, s := range samples {
+		ms[i] = s.(*custom).Metric
+	}
+	a.Aggregate(roll, ms)
+}
+
+func (c *custom) MarshalJSON() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	return json.Marshal(c.Metric)
+}
@@ -0,0 +1,97 @@
+package metric
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// TopK is a metric that keeps track of the most frequent keys.
+type TopK interface {
+	Metric
+	Inc(key string)
+}
+
+// NewTopK returns a metric that tracks approximately the k most frequent keys
+// using the Space-Saving algorithm, so memory stays bounded regardless of the
+// number of distinct keys. Each reported count may overestimate the real one
+// by at most the reported error, which itself never exceeds N/k for N total
+// increments. Numbers passed to Add are tracked as keys, too.
+func NewTopK(k int) TopK {
+	if k < 1 {
+		k = 1
+	}
+	return &topk{k: k, items: map[string]*topkItem{}}
+}
+
+type topkItem struct {
+	Key   string  `json:"key"`
+	Count float64 `json:"count"`
+	Error float64 `json:"error"`
+}
+
+type topk struct {
+	sync.Mutex
+	k     int
+	items map[string]*topkItem
+}
+
+func (t *topk) Inc(key string) {
+	t.Lock()
+	defer t.Unlock()
+	if item, ok := t.items[key]; ok {
+		item.Count++
+		return
+	}
+	if len(t.items) < t.k {
+		t.items[key] = &topkItem{Key: key, Count: 1}
+		return
+	}
+	// Replace the least frequent key, inheriting its count as the error bound
+	var min *topkItem
+	for _, item := range t.items {
+		if min == nil || item.Count < min.Count {
+			min = item
+		}
+	}
+	delete(t.items, min.Key)
+	t.items[key] = &topkItem{Key: key, Count: min.Count + 1, Error: min.Count}
+}
+
+func (t *topk) Add(n float64) {
+	t.Inc(strconv.FormatFloat(n, 'g', -1, 64))
+}
+
+func (t *topk) Reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.items = map[string]*topkItem{}
+}
+
+func (t *topk) sorted() []topkItem {
+	items := make([]topkItem, 0, len(t.items))
+	for _, item := range t.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+func (t *topk) MarshalJSON() ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+	return marshal(struct {
+		Type  string     `json:"type"`
+		Items []topkItem `json:"items"`
+	}{"topk", t.sorted()})
+}
+
+func (t *topk) String() string {
+	b, _ := t.MarshalJSON()
+	return string(b)
+}